@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/jfreymuth/oggvorbis"
+)
+
+// audio is a decoded song, mixed down to mono.
+type audio struct {
+	samples    []float32
+	sampleRate int
+}
+
+// Seconds returns the length of the audio.
+func (a *audio) Seconds() float64 {
+	return float64(len(a.samples)) / float64(a.sampleRate)
+}
+
+// loadAudio decodes an OGG Vorbis or WAV file. Beat Saber songs are OGG
+// Vorbis files, usually with an .egg extension, so the format is told by
+// the file's contents rather than its name.
+func loadAudio(filePath string) (*audio, error) {
+	raw, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var a *audio
+	switch {
+	case bytes.HasPrefix(raw, []byte("OggS")):
+		a, err = decodeOgg(raw)
+	case len(raw) >= 12 && string(raw[:4]) == "RIFF" && string(raw[8:12]) == "WAVE":
+		a, err = decodeWAV(raw)
+	default:
+		return nil, fmt.Errorf("audio '%s': not an OGG Vorbis or WAV file", filePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("audio '%s': %s", filePath, err)
+	}
+	if len(a.samples) == 0 {
+		return nil, fmt.Errorf("audio '%s': no samples", filePath)
+	}
+	return a, nil
+}
+
+func decodeOgg(raw []byte) (*audio, error) {
+	r, err := oggvorbis.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	channels := r.Channels()
+	a := &audio{sampleRate: r.SampleRate()}
+	buffer := make([]float32, 4096*channels)
+	for {
+		n, err := r.Read(buffer)
+		for i := 0; i+channels <= n; i += channels {
+			var sum float32
+			for _, sample := range buffer[i : i+channels] {
+				sum += sample
+			}
+			a.samples = append(a.samples, sum/float32(channels))
+		}
+		if err == io.EOF {
+			return a, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// WAV format tags.
+const (
+	wavPCM        = 1
+	wavFloat      = 3
+	wavExtensible = 0xfffe
+)
+
+// decodeWAV decodes a RIFF WAVE file with 8, 16, 24 or 32 bit integer or 32
+// or 64 bit float samples.
+func decodeWAV(raw []byte) (*audio, error) {
+	var format, channels, bits int
+	a := &audio{}
+	var data []byte
+	for chunks := raw[12:]; len(chunks) >= 8; {
+		id := string(chunks[:4])
+		size := int(binary.LittleEndian.Uint32(chunks[4:8]))
+		chunks = chunks[8:]
+		if size > len(chunks) {
+			// Some writers leave the data size unset when streaming.
+			if id != "data" {
+				return nil, fmt.Errorf("chunk '%s' is cut off", id)
+			}
+			size = len(chunks)
+		}
+		body := chunks[:size]
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return nil, errors.New("fmt chunk is too short")
+			}
+			format = int(binary.LittleEndian.Uint16(body[0:2]))
+			channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			a.sampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+			bits = int(binary.LittleEndian.Uint16(body[14:16]))
+			// WAVE_FORMAT_EXTENSIBLE keeps the real format tag at the start
+			// of its sub-format GUID.
+			if format == wavExtensible && size >= 26 {
+				format = int(binary.LittleEndian.Uint16(body[24:26]))
+			}
+		case "data":
+			data = body
+		}
+		chunks = chunks[size:]
+		if size%2 == 1 && len(chunks) > 0 {
+			chunks = chunks[1:]
+		}
+	}
+	if channels == 0 || a.sampleRate == 0 {
+		return nil, errors.New("no fmt chunk")
+	}
+	if data == nil {
+		return nil, errors.New("no data chunk")
+	}
+
+	var sample func(b []byte) float32
+	switch {
+	case format == wavPCM && bits == 8:
+		sample = func(b []byte) float32 { return (float32(b[0]) - 128) / 128 }
+	case format == wavPCM && bits == 16:
+		sample = func(b []byte) float32 { return float32(int16(binary.LittleEndian.Uint16(b))) / (1 << 15) }
+	case format == wavPCM && bits == 24:
+		sample = func(b []byte) float32 {
+			return float32(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+		}
+	case format == wavPCM && bits == 32:
+		sample = func(b []byte) float32 { return float32(int32(binary.LittleEndian.Uint32(b))) / (1 << 31) }
+	case format == wavFloat && bits == 32:
+		sample = func(b []byte) float32 { return math.Float32frombits(binary.LittleEndian.Uint32(b)) }
+	case format == wavFloat && bits == 64:
+		sample = func(b []byte) float32 { return float32(math.Float64frombits(binary.LittleEndian.Uint64(b))) }
+	default:
+		return nil, fmt.Errorf("unsupported format %d with %d bit samples", format, bits)
+	}
+
+	width := bits / 8
+	frame := width * channels
+	a.samples = make([]float32, 0, len(data)/frame)
+	for ; len(data) >= frame; data = data[frame:] {
+		var sum float32
+		for c := 0; c < channels; c++ {
+			sum += sample(data[c*width:])
+		}
+		a.samples = append(a.samples, sum/float32(channels))
+	}
+	return a, nil
+}
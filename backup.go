@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/andlabs/ui"
+)
+
+// backup is a copy of the output files that a conversion replaced, kept in
+// the cache folder so that converting into the wrong folder can be undone.
+type backup struct {
+	ID           string
+	OutputFolder string
+	Time         time.Time
+	Files        []string
+	// Created are the files the conversion added, which restoring the
+	// backup deletes.
+	Created []string
+}
+
+func (b backup) String() string {
+	return fmt.Sprintf("%s  %s  (%d files, %d new)", b.Time.Format("2006-01-02 15:04:05"), b.OutputFolder, len(b.Files), len(b.Created))
+}
+
+// backupTimeFormat starts the names of the backup folders, so that they sort
+// by age. A random suffix keeps backups made in the same millisecond, as in
+// a batch conversion, apart.
+const backupTimeFormat = "20060102-150405.000"
+
+func backupsFolder() string {
+	return filepath.Join(configDirs.QueryCacheFolder().Path, "backups")
+}
+
+// backupOutput copies the files in the output folder that tx is about to
+// replace or delete into a new backup, and lists the ones it adds.
+func backupOutput(tx *outputTransaction) error {
+	var files, created []string
+	for _, relativePath := range tx.files {
+		if _, err := os.Lstat(filepath.Join(tx.folder, relativePath)); err == nil {
+			files = append(files, relativePath)
+		} else if !tx.removed[relativePath] {
+			created = append(created, relativePath)
+		}
+	}
+	if len(files) == 0 && len(created) == 0 {
+		return nil
+	}
+
+	outputFolder, err := filepath.Abs(tx.folder)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(backupsFolder(), 0755); err != nil {
+		return fmt.Errorf("backup: %s", err)
+	}
+	now := time.Now()
+	folder, err := ioutil.TempDir(backupsFolder(), now.Format(backupTimeFormat)+"-")
+	if err != nil {
+		return fmt.Errorf("backup: %s", err)
+	}
+	b := backup{ID: filepath.Base(folder), OutputFolder: outputFolder, Time: now, Files: files, Created: created}
+	for _, relativePath := range files {
+		if err := copyAsset(filepath.Join(tx.folder, relativePath), filepath.Join(folder, "files", relativePath), false); err != nil {
+			os.RemoveAll(folder)
+			return fmt.Errorf("backup of '%s': %s", relativePath, err)
+		}
+	}
+	buf, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(folder, "backup.json"), buf, 0644)
+}
+
+// listBackups returns the backups, newest first.
+func listBackups() ([]backup, error) {
+	entries, err := ioutil.ReadDir(backupsFolder())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var backups []backup
+	for _, entry := range entries {
+		buf, err := ioutil.ReadFile(filepath.Join(backupsFolder(), entry.Name(), "backup.json"))
+		if err != nil {
+			continue
+		}
+		var b backup
+		if err := json.Unmarshal(buf, &b); err != nil {
+			continue
+		}
+		backups = append(backups, b)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].ID > backups[j].ID })
+	return backups, nil
+}
+
+// restoreBackup puts the files of b back into the folder they came from and
+// deletes the ones the conversion added. The restore goes through a
+// transaction like a conversion does, so it is backed up in turn.
+func restoreBackup(b backup) error {
+	if err := os.MkdirAll(b.OutputFolder, 0755); err != nil {
+		return err
+	}
+	tx, err := newOutputTransaction(b.OutputFolder)
+	if err != nil {
+		return err
+	}
+	defer tx.abort()
+	for _, relativePath := range b.Files {
+		if err := tx.CopyFile(filepath.Join(backupsFolder(), b.ID, "files", relativePath), relativePath, false); err != nil {
+			return fmt.Errorf("backup %s: %s", b.ID, err)
+		}
+	}
+	for _, relativePath := range b.Created {
+		if err := tx.Remove(relativePath); err != nil {
+			return fmt.Errorf("backup %s: %s", b.ID, err)
+		}
+	}
+	if err := backupOutput(tx); err != nil {
+		return err
+	}
+	return tx.commit()
+}
+
+// runRestore is the restore command. Without arguments it lists the
+// backups; given a backup ID it restores that backup.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	backups, err := listBackups()
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		printBackups(os.Stdout, backups)
+		return nil
+	}
+	for _, b := range backups {
+		if b.ID == fs.Arg(0) {
+			if err := restoreBackup(b); err != nil {
+				return err
+			}
+			fmt.Printf("restored %d files to %s and removed %d\n", len(b.Files), b.OutputFolder, len(b.Created))
+			return nil
+		}
+	}
+	return fmt.Errorf("restore: no backup '%s'", fs.Arg(0))
+}
+
+func printBackups(w io.Writer, backups []backup) {
+	if len(backups) == 0 {
+		fmt.Fprintln(w, "no backups")
+		return
+	}
+	for _, b := range backups {
+		fmt.Fprintf(w, "%s  %s\n", b.ID, b)
+	}
+}
+
+// showRestoreWindow opens a window for picking a backup to restore.
+func showRestoreWindow(parent *ui.Window) {
+	backups, err := listBackups()
+	if err != nil {
+		ui.MsgBoxError(parent, "error", "couldn't list backups: "+err.Error())
+		return
+	}
+	if len(backups) == 0 {
+		ui.MsgBox(parent, "restore", "there are no backups yet")
+		return
+	}
+
+	window := ui.NewWindow("Restore a backup", 600, 100, false)
+	backupsCombobox := ui.NewCombobox()
+	for _, b := range backups {
+		backupsCombobox.Append(b.String())
+	}
+	backupsCombobox.SetSelected(0)
+	button := ui.NewButton("Restore")
+	button.OnClicked(func(*ui.Button) {
+		b := backups[backupsCombobox.Selected()]
+		if err := restoreBackup(b); err != nil {
+			ui.MsgBoxError(window, "restore error", err.Error())
+			return
+		}
+		ui.MsgBox(window, "success", fmt.Sprintf("restored %d files to %s and removed %d", len(b.Files), b.OutputFolder, len(b.Created)))
+		window.Destroy()
+	})
+
+	box := ui.NewVerticalBox()
+	box.SetPadded(true)
+	box.Append(ui.NewLabel("Files replaced by a conversion are backed up first. Pick a conversion to undo:"), false)
+	box.Append(backupsCombobox, false)
+	box.Append(button, false)
+	window.SetMargined(true)
+	window.SetChild(box)
+	window.OnClosing(func(*ui.Window) bool {
+		return true
+	})
+	window.Show()
+}
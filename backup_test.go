@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// useTestCache points the cache folder, and with it the backups, at a
+// folder of its own, and returns a function that removes it again.
+func useTestCache(t *testing.T) func() {
+	applicationName := configDirs.ApplicationName
+	configDirs.ApplicationName = "bpm-saber-test-" + strconv.Itoa(os.Getpid())
+	if err := os.RemoveAll(configDirs.QueryCacheFolder().Path); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		os.RemoveAll(configDirs.QueryCacheFolder().Path)
+		configDirs.ApplicationName = applicationName
+	}
+}
+
+func TestBackupOutputConcurrent(t *testing.T) {
+	defer useTestCache(t)()
+	root, err := ioutil.TempDir("", "bpm-saber-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Backups started together are likely to share a millisecond, which
+	// must not make them share a folder.
+	const songs = 20
+	var wait sync.WaitGroup
+	errs := make([]error, songs)
+	for i := 0; i < songs; i++ {
+		folder := filepath.Join(root, strconv.Itoa(i))
+		if err := os.MkdirAll(folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(folder, "Expert.dat"), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tx, err := newOutputTransaction(folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.abort()
+		if err := tx.WriteFile("Expert.dat", []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			errs[i] = backupOutput(tx)
+		}(i)
+	}
+	wait.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := listBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != songs {
+		t.Fatalf("got %d backups, want %d", len(backups), songs)
+	}
+	folders := map[string]bool{}
+	for _, b := range backups {
+		if folders[b.OutputFolder] {
+			t.Errorf("two backups of %s", b.OutputFolder)
+		}
+		folders[b.OutputFolder] = true
+		saved, err := ioutil.ReadFile(filepath.Join(backupsFolder(), b.ID, "files", "Expert.dat"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(saved) != "old" {
+			t.Errorf("backup %s of %s holds '%s', want 'old'", b.ID, b.OutputFolder, saved)
+		}
+	}
+}
+
+func TestRestoreRemovesCreatedFiles(t *testing.T) {
+	defer useTestCache(t)()
+	folder, err := ioutil.TempDir("", "bpm-saber-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	if err := ioutil.WriteFile(filepath.Join(folder, "Expert.dat"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := newOutputTransaction(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.abort()
+	for _, relativePath := range []string{"Expert.dat", "Lightshow.dat"} {
+		if err := tx.WriteFile(relativePath, []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := backupOutput(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := listBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("got %d backups, want 1", len(backups))
+	}
+	if err := restoreBackup(backups[0]); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := ioutil.ReadFile(filepath.Join(folder, "Expert.dat")); err != nil || string(saved) != "old" {
+		t.Errorf("Expert.dat after restore: '%s', %v, want 'old'", saved, err)
+	}
+	if _, err := os.Lstat(filepath.Join(folder, "Lightshow.dat")); !os.IsNotExist(err) {
+		t.Errorf("Lightshow.dat is still there after restore: %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// batchRule decides the output BPM of each song in a batch from its input
+// BPM. Rules are written like
+//
+//	ratio 1/3
+//	bpm 120
+//	ratio 1/3 if bpm > 300
+//
+// A ratio multiplies the input BPM, bpm sets the output BPM outright, and
+// the optional condition limits the rule to some songs; the others are
+// skipped.
+type batchRule struct {
+	text      string
+	ratio     *big.Rat
+	bpm       float64
+	operator  string
+	threshold float64
+}
+
+func parseBatchRule(text string) (batchRule, error) {
+	rule := batchRule{text: text}
+	fields := strings.Fields(strings.ToLower(text))
+	if len(fields) != 2 && len(fields) != 6 {
+		return rule, fmt.Errorf("rule '%s': must look like 'ratio N/D' or 'bpm N', optionally followed by 'if bpm > N'", text)
+	}
+	var err error
+	switch fields[0] {
+	case "ratio":
+		rule.ratio, err = parseRatio(fields[1])
+	case "bpm":
+		if rule.bpm, err = parsePositiveFloat(fields[1]); err != nil {
+			err = fmt.Errorf("invalid bpm '%s'", fields[1])
+		}
+	default:
+		err = fmt.Errorf("unknown rule '%s'", fields[0])
+	}
+	if err != nil {
+		return rule, fmt.Errorf("rule '%s': %s", text, err)
+	}
+	if len(fields) == 2 {
+		return rule, nil
+	}
+
+	switch fields[4] {
+	case ">", ">=", "<", "<=", "=":
+		rule.operator = fields[4]
+	default:
+		return rule, fmt.Errorf("rule '%s': unknown comparison '%s'", text, fields[4])
+	}
+	if fields[2] != "if" || fields[3] != "bpm" {
+		return rule, fmt.Errorf("rule '%s': conditions must look like 'if bpm > N'", text)
+	}
+	if rule.threshold, err = parsePositiveFloat(fields[5]); err != nil {
+		return rule, fmt.Errorf("rule '%s': invalid threshold '%s'", text, fields[5])
+	}
+	return rule, nil
+}
+
+// parseRatio parses a ratio written as a fraction, like 1/3 or 1.5/2, or as
+// a plain number.
+func parseRatio(text string) (*big.Rat, error) {
+	parts := strings.Split(text, "/")
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("invalid ratio '%s'", text)
+	}
+	ratio, err := parsePositiveRat(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ratio '%s'", text)
+	}
+	if len(parts) == 2 {
+		denominator, err := parsePositiveRat(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ratio '%s'", text)
+		}
+		ratio.Quo(ratio, denominator)
+	}
+	return ratio, nil
+}
+
+// Apply returns the output BPM for a song at inputBPM, or false if the rule
+// doesn't apply to it.
+func (r batchRule) Apply(inputBPM float64) (float64, bool) {
+	switch r.operator {
+	case ">":
+		if !(inputBPM > r.threshold) {
+			return 0, false
+		}
+	case ">=":
+		if !(inputBPM >= r.threshold) {
+			return 0, false
+		}
+	case "<":
+		if !(inputBPM < r.threshold) {
+			return 0, false
+		}
+	case "<=":
+		if !(inputBPM <= r.threshold) {
+			return 0, false
+		}
+	case "=":
+		if inputBPM != r.threshold {
+			return 0, false
+		}
+	}
+	if r.bpm != 0 {
+		return r.bpm, true
+	}
+	return convertTime(inputBPM, r.ratio), true
+}
+
+func (r batchRule) String() string { return r.text }
+
+// songResult is the outcome of one song of a batch.
+type songResult struct {
+	// Folder is the song folder relative to the batch's input folder.
+	Folder    string
+	InputBPM  float64
+	OutputBPM float64
+	Skipped   bool
+	Results   []difficultyResult
+	Err       error
+}
+
+// findSongs returns every song folder under root, skipping the folder
+// skip and everything in it, so that an output tree inside the input tree
+// isn't picked up as more input.
+func findSongs(root, skip string) ([]string, error) {
+	var folders []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if skip != "" && sameFile(path, skip) && path != root {
+			return filepath.SkipDir
+		}
+		if strings.HasPrefix(info.Name(), ".bpm-saber-") {
+			return filepath.SkipDir
+		}
+		if _, err := findSongInfo(path); err == nil {
+			folders = append(folders, path)
+		}
+		return nil
+	})
+	return folders, err
+}
+
+// convertBatch converts every song under template.InputFolder into the same
+// place under template.OutputFolder, with the BPMs from rule and the other
+// options from template. Songs are converted in parallel, and a song that
+// fails doesn't stop the others. The results are in the order the songs
+// were found in, however long each one took.
+func convertBatch(ctx context.Context, template *inputFields, rule batchRule) ([]songResult, error) {
+	folders, err := findSongs(template.InputFolder, template.OutputFolder)
+	if err != nil {
+		return nil, err
+	}
+	songs := make([]songResult, len(folders))
+	for i, folder := range folders {
+		songs[i].Folder = folder
+		if rel, err := filepath.Rel(template.InputFolder, folder); err == nil {
+			songs[i].Folder = rel
+		}
+		// Songs that cancelling stops from starting keep this.
+		songs[i].Err = context.Canceled
+	}
+	forEach(ctx, len(folders), func(ctx context.Context, i int) error {
+		songs[i] = convertSong(ctx, template, rule, folders[i], songs[i].Folder)
+		return nil
+	})
+	return songs, nil
+}
+
+func convertSong(ctx context.Context, template *inputFields, rule batchRule, folder, relativeFolder string) songResult {
+	song := songResult{Folder: relativeFolder}
+	song.InputBPM, song.Err = loadBpmFromFolder(folder)
+	if song.Err != nil {
+		return song
+	}
+	var ok bool
+	if song.OutputBPM, ok = rule.Apply(song.InputBPM); !ok {
+		song.Skipped = true
+		return song
+	}
+
+	songInfoPath, err := findSongInfo(folder)
+	if err != nil {
+		song.Err = err
+		return song
+	}
+	inputs, err := validateInputs(songInfoPath, filepath.Join(template.OutputFolder, song.Folder), floatToString(song.InputBPM), floatToString(song.OutputBPM))
+	if err != nil {
+		song.Err = err
+		return song
+	}
+	// A ratio rule gives the ratio exactly, where the output BPM is rounded.
+	if rule.ratio != nil {
+		inputs.Ratio = rule.ratio
+	}
+	inputs.FullSong = template.FullSong
+	inputs.LinkAssets = template.LinkAssets
+	inputs.Snap = template.Snap
+	report, err := process(ctx, inputs, nil)
+	if err != nil {
+		song.Err = err
+		return song
+	}
+	song.Results = report.Difficulties
+	return song
+}
+
+// runBatch handles the "batch" subcommand.
+func runBatch(args []string) error {
+	fs := flag.NewFlagSet("batch", flag.ContinueOnError)
+	inputFolder := fs.String("inputFolder", "", "folder to search for songs, such as CustomWIPLevels")
+	outputFolder := fs.String("outputFolder", "", "folder to write the converted songs to, in the same layout")
+	ruleText := fs.String("rule", "", "how to pick each song's output BPM, such as 'ratio 1/3 if bpm > 300'")
+	fullSong := fs.Bool("fullSong", true, "also write the song info and copy the audio and cover")
+	linkAssets := fs.Bool("link", false, "hard-link the audio and cover instead of copying them")
+	snap := fs.Int("snap", 0, "round converted beats to the nearest 1/N beat, 0 to keep them exact")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("batch: unexpected argument '%s'", fs.Arg(0))
+	}
+	for _, required := range []struct{ name, value string }{
+		{"inputFolder", *inputFolder},
+		{"outputFolder", *outputFolder},
+		{"rule", *ruleText},
+	} {
+		if required.value == "" {
+			return errors.New("batch: missing required flag -" + required.name)
+		}
+	}
+	if err := ensureDir(*inputFolder); err != nil {
+		return fmt.Errorf("input folder '%s': %s", *inputFolder, err)
+	}
+	rule, err := parseBatchRule(*ruleText)
+	if err != nil {
+		return err
+	}
+	if *snap < 0 {
+		return errors.New("batch: -snap must be 0 or more")
+	}
+
+	if err := os.MkdirAll(*outputFolder, 0755); err != nil {
+		return fmt.Errorf("couldn't create output folder '%s': %s", *outputFolder, err)
+	}
+	template := &inputFields{
+		InputFolder:  *inputFolder,
+		OutputFolder: *outputFolder,
+		FullSong:     *fullSong,
+		LinkAssets:   *linkAssets,
+		Snap:         *snap,
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	songs, err := convertBatch(ctx, template, rule)
+	if err != nil {
+		return err
+	}
+	printBatchReport(os.Stdout, songs)
+	failed := 0
+	for _, song := range songs {
+		if song.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("batch: %d of %d songs failed", failed, len(songs))
+	}
+	return nil
+}
+
+func printBatchReport(w io.Writer, songs []songResult) {
+	converted, skipped, failed := 0, 0, 0
+	for _, song := range songs {
+		switch {
+		case song.Err != nil:
+			failed++
+			fmt.Fprintf(w, "FAIL %s: %s\n", song.Folder, song.Err)
+		case song.Skipped:
+			skipped++
+			fmt.Fprintf(w, "skip %s: %s BPM, rule doesn't apply\n", song.Folder, floatToString(song.InputBPM))
+		default:
+			converted++
+			fmt.Fprintf(w, "ok   %s: %s BPM -> %s BPM, %d difficulties\n", song.Folder, floatToString(song.InputBPM), floatToString(song.OutputBPM), len(song.Results))
+			for _, result := range song.Results {
+				for _, warning := range result.Warnings {
+					fmt.Fprintf(w, "       warning: %s: %s\n", result.Difficulty, warning)
+				}
+			}
+		}
+	}
+	fmt.Fprintf(w, "%d songs converted, %d skipped, %d failed\n", converted, skipped, failed)
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestParseBatchRule(t *testing.T) {
+	tests := []struct {
+		text, err string
+	}{
+		{"ratio 1/3", ""},
+		{"bpm 120", ""},
+		{"Ratio 1/3 if BPM > 300", ""},
+		{"bpm 120 if bpm <= 90.5", ""},
+		{"ratio", "rule 'ratio': must look like 'ratio N/D' or 'bpm N', optionally followed by 'if bpm > N'"},
+		{"ratio 1/3 if bpm >", "rule 'ratio 1/3 if bpm >': must look like 'ratio N/D' or 'bpm N', optionally followed by 'if bpm > N'"},
+		{"speed 2", "rule 'speed 2': unknown rule 'speed'"},
+		{"ratio 1/0", "rule 'ratio 1/0': invalid ratio '1/0'"},
+		{"bpm 0", "rule 'bpm 0': invalid bpm '0'"},
+		{"bpm fast", "rule 'bpm fast': invalid bpm 'fast'"},
+		{"ratio 1/3 if bpm ! 300", "rule 'ratio 1/3 if bpm ! 300': unknown comparison '!'"},
+		{"ratio 1/3 when bpm > 300", "rule 'ratio 1/3 when bpm > 300': conditions must look like 'if bpm > N'"},
+		{"ratio 1/3 if bpm > 0", "rule 'ratio 1/3 if bpm > 0': invalid threshold '0'"},
+		{"ratio 1/3 if bpm > x", "rule 'ratio 1/3 if bpm > x': invalid threshold 'x'"},
+	}
+	for _, test := range tests {
+		_, err := parseBatchRule(test.text)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.err {
+			t.Errorf("parseBatchRule('%s') = '%s', want '%s'", test.text, got, test.err)
+		}
+	}
+}
+
+func TestBatchRuleApply(t *testing.T) {
+	tests := []struct {
+		rule    string
+		input   float64
+		want    float64
+		applies bool
+	}{
+		{"ratio 1/3", 360, 120, true},
+		{"bpm 120", 87, 120, true},
+		{"ratio 1/2 if bpm > 300", 400, 200, true},
+		{"ratio 1/2 if bpm > 300", 300, 0, false},
+		{"ratio 1/2 if bpm >= 300", 300, 150, true},
+		{"ratio 2 if bpm < 100", 100, 0, false},
+		{"ratio 2 if bpm <= 100", 100, 200, true},
+		{"bpm 90 if bpm = 180", 180, 90, true},
+		{"bpm 90 if bpm = 180", 181, 0, false},
+	}
+	for _, test := range tests {
+		rule, err := parseBatchRule(test.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, applies := rule.Apply(test.input)
+		if got != test.want || applies != test.applies {
+			t.Errorf("'%s'.Apply(%v) = %v, %v, want %v, %v", test.rule, test.input, got, applies, test.want, test.applies)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+// BeatMapV3 is the difficulty layout introduced with game version 1.20,
+// which uses short keys ("b" for beat) and splits notes, bombs, arcs and
+// chains into separate lists. As with the v2 types, only the fields that
+// hold beats are modeled and everything else is carried along in raw.
+type BeatMapV3 struct {
+	Version                 string       `json:"version"`
+	BPMEvents               []BPMEvent   `json:"bpmEvents"`
+	RotationEvents          []BeatObject `json:"rotationEvents"`
+	ColorNotes              []BeatObject `json:"colorNotes"`
+	BombNotes               []BeatObject `json:"bombNotes"`
+	Obstacles               []ObstacleV3 `json:"obstacles"`
+	Sliders                 []SliderV3   `json:"sliders"`
+	BurstSliders            []SliderV3   `json:"burstSliders"`
+	Waypoints               []BeatObject `json:"waypoints"`
+	BasicBeatmapEvents      []BeatObject `json:"basicBeatmapEvents"`
+	ColorBoostBeatmapEvents []BeatObject `json:"colorBoostBeatmapEvents"`
+
+	LightColorEventBoxGroups       []LightEventBoxGroup `json:"lightColorEventBoxGroups"`
+	LightRotationEventBoxGroups    []LightEventBoxGroup `json:"lightRotationEventBoxGroups"`
+	LightTranslationEventBoxGroups []LightEventBoxGroup `json:"lightTranslationEventBoxGroups"`
+	VFXEventBoxGroups              []VFXEventBoxGroup   `json:"vfxEventBoxGroups"`
+	FXEventsCollection             *FXEventsCollection  `json:"_fxEventsCollection"`
+	CustomData                     *CustomDataV3        `json:"customData"`
+
+	raw rawObject
+}
+
+// CustomDataV3 is the part of customData that holds beat positions.
+type CustomDataV3 struct {
+	Bookmarks []BeatObject `json:"bookmarks"`
+
+	raw rawObject
+}
+
+// BeatObject is any v3 object whose only time field is its beat.
+type BeatObject struct {
+	Beat float64 `json:"b"`
+
+	raw rawObject
+}
+
+type BPMEvent struct {
+	Beat float64 `json:"b"`
+	BPM  float64 `json:"m"`
+
+	raw rawObject
+}
+
+type ObstacleV3 struct {
+	Beat     float64 `json:"b"`
+	Duration float64 `json:"d"`
+
+	raw rawObject
+}
+
+// SliderV3 is used for both arcs ("sliders") and chains ("burstSliders"),
+// which share their head and tail beat keys.
+type SliderV3 struct {
+	Beat     float64 `json:"b"`
+	TailBeat float64 `json:"tb"`
+
+	raw rawObject
+}
+
+func (b *BeatMapV3) Rescale(c beatConverter) {
+	for i, event := range b.BPMEvents {
+		b.BPMEvents[i].Beat = c.Beat(event.Beat)
+		b.BPMEvents[i].BPM = c.Tempo(event.Beat, event.BPM)
+	}
+	for _, objects := range [][]BeatObject{
+		b.RotationEvents,
+		b.ColorNotes,
+		b.BombNotes,
+		b.Waypoints,
+		b.BasicBeatmapEvents,
+		b.ColorBoostBeatmapEvents,
+	} {
+		for i, object := range objects {
+			objects[i].Beat = c.Beat(object.Beat)
+		}
+	}
+	for i, obstacle := range b.Obstacles {
+		b.Obstacles[i].Beat = c.Beat(obstacle.Beat)
+		b.Obstacles[i].Duration = c.Duration(obstacle.Beat, obstacle.Duration)
+	}
+	for _, sliders := range [][]SliderV3{b.Sliders, b.BurstSliders} {
+		for i, slider := range sliders {
+			sliders[i].Beat = c.Beat(slider.Beat)
+			sliders[i].TailBeat = c.Beat(slider.TailBeat)
+		}
+	}
+	for _, groups := range [][]LightEventBoxGroup{
+		b.LightColorEventBoxGroups,
+		b.LightRotationEventBoxGroups,
+		b.LightTranslationEventBoxGroups,
+	} {
+		rescaleLightEventBoxGroups(groups, c)
+	}
+	if b.FXEventsCollection == nil {
+		b.FXEventsCollection = &FXEventsCollection{}
+	}
+	rescaleVFXEventBoxGroups(b.VFXEventBoxGroups, b.FXEventsCollection, c)
+	if b.CustomData != nil {
+		for i, bookmark := range b.CustomData.Bookmarks {
+			b.CustomData.Bookmarks[i].Beat = c.Beat(bookmark.Beat)
+		}
+	}
+}
+
+func (b *BeatMapV3) SetTempoChanges(changes []tempoChange) {
+	b.BPMEvents = nil
+	for _, change := range changes {
+		b.BPMEvents = append(b.BPMEvents, BPMEvent{Beat: change.Beat, BPM: change.BPM})
+	}
+	b.raw.include("bpmEvents")
+}
+
+func (b *BeatMapV3) TempoChanges() []tempoChange {
+	var changes []tempoChange
+	for _, event := range b.BPMEvents {
+		changes = append(changes, tempoChange{Beat: event.Beat, BPM: event.BPM})
+	}
+	return changes
+}
+
+// SetBPM does nothing; v3 difficulties take their BPM from the song info and
+// bpmEvents, which Rescale already converts.
+func (b *BeatMapV3) SetBPM(bpm float64) {}
+
+// SetBeatsPerBar does nothing; v3 difficulties have no bar length.
+func (b *BeatMapV3) SetBeatsPerBar(beats int) {}
+
+func (b *BeatMapV3) Counts() (notes, obstacles, events int) {
+	notes = len(b.ColorNotes) + len(b.BombNotes)
+	events = len(b.BasicBeatmapEvents) + len(b.ColorBoostBeatmapEvents) + len(b.RotationEvents) + len(b.BPMEvents)
+	events += countLightEvents(b.LightColorEventBoxGroups) + countLightEvents(b.LightRotationEventBoxGroups) + countLightEvents(b.LightTranslationEventBoxGroups)
+	for _, group := range b.VFXEventBoxGroups {
+		for _, box := range group.Boxes {
+			events += len(box.EventIndices)
+		}
+	}
+	return notes, len(b.Obstacles), events
+}
+
+func (b *BeatMapV3) Times() beatTimes {
+	var times beatTimes
+	times.Notes = appendBeats(appendBeats(nil, b.ColorNotes), b.BombNotes)
+	for _, obstacle := range b.Obstacles {
+		times.Obstacles = append(times.Obstacles, obstacle.Beat)
+	}
+	times.Events = appendBeats(appendBeats(appendBeats(nil, b.BasicBeatmapEvents), b.ColorBoostBeatmapEvents), b.RotationEvents)
+	for _, event := range b.BPMEvents {
+		times.Events = append(times.Events, event.Beat)
+	}
+	for _, groups := range [][]LightEventBoxGroup{b.LightColorEventBoxGroups, b.LightRotationEventBoxGroups, b.LightTranslationEventBoxGroups} {
+		times.Events = appendLightEventBeats(times.Events, groups)
+	}
+	for _, group := range b.VFXEventBoxGroups {
+		for _, box := range group.Boxes {
+			for _, index := range box.EventIndices {
+				beat := group.Beat
+				if b.FXEventsCollection != nil && index >= 0 && index < len(b.FXEventsCollection.FloatEvents) {
+					beat += b.FXEventsCollection.FloatEvents[index].Beat
+				}
+				times.Events = append(times.Events, beat)
+			}
+		}
+	}
+	return times
+}
+
+func (b *BeatMapV3) UnmarshalJSON(data []byte) error {
+	type beatMapV3 BeatMapV3
+	return unmarshalObject(data, (*beatMapV3)(b), &b.raw)
+}
+
+func (b BeatMapV3) MarshalJSON() ([]byte, error) {
+	type beatMapV3 BeatMapV3
+	return marshalObject(beatMapV3(b), b.raw)
+}
+
+func (d *CustomDataV3) UnmarshalJSON(data []byte) error {
+	type customDataV3 CustomDataV3
+	return unmarshalObject(data, (*customDataV3)(d), &d.raw)
+}
+
+func (d CustomDataV3) MarshalJSON() ([]byte, error) {
+	type customDataV3 CustomDataV3
+	return marshalObject(customDataV3(d), d.raw)
+}
+
+func (o *BeatObject) UnmarshalJSON(data []byte) error {
+	type beatObject BeatObject
+	return unmarshalObject(data, (*beatObject)(o), &o.raw)
+}
+
+func (o BeatObject) MarshalJSON() ([]byte, error) {
+	type beatObject BeatObject
+	return marshalObject(beatObject(o), o.raw)
+}
+
+func (e *BPMEvent) UnmarshalJSON(data []byte) error {
+	type bpmEvent BPMEvent
+	return unmarshalObject(data, (*bpmEvent)(e), &e.raw)
+}
+
+func (e BPMEvent) MarshalJSON() ([]byte, error) {
+	type bpmEvent BPMEvent
+	return marshalObject(bpmEvent(e), e.raw)
+}
+
+func (o *ObstacleV3) UnmarshalJSON(data []byte) error {
+	type obstacleV3 ObstacleV3
+	return unmarshalObject(data, (*obstacleV3)(o), &o.raw)
+}
+
+func (o ObstacleV3) MarshalJSON() ([]byte, error) {
+	type obstacleV3 ObstacleV3
+	return marshalObject(obstacleV3(o), o.raw)
+}
+
+func (s *SliderV3) UnmarshalJSON(data []byte) error {
+	type sliderV3 SliderV3
+	return unmarshalObject(data, (*sliderV3)(s), &s.raw)
+}
+
+func (s SliderV3) MarshalJSON() ([]byte, error) {
+	type sliderV3 SliderV3
+	return marshalObject(sliderV3(s), s.raw)
+}
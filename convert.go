@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+)
+
+// runConvert handles the "convert" subcommand. It converts a song folder
+// using only command line flags and never starts the GUI, so it can be run
+// from scripts and on machines without a display.
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	inputFolder := fs.String("inputFolder", "", "folder with existing BPM")
+	outputFolder := fs.String("outputFolder", "", "folder to save new BPM")
+	inputBPM := fs.String("inputBPM", "", "intended initial BPM")
+	outputBPM := fs.String("outputBPM", "", "intended new BPM")
+	fullSong := fs.Bool("fullSong", false, "also write the song info and copy the audio and cover")
+	linkAssets := fs.Bool("link", false, "hard-link the audio and cover instead of copying them")
+	snap := fs.Int("snap", 0, "round converted beats to the nearest 1/N beat, 0 to keep them exact")
+	meterText := fs.String("meter", "", "the song's real time signature, such as 6/8, which sets the output's beats per bar and, without -outputBPM, its BPM")
+	editorMeterText := fs.String("editorMeter", "", "the time signature the editor assumed, for -meter, whose 1/N note is the editor's beat (default the -meter one)")
+	offsetText := fs.String("offset", "keep", "keep the difficulty offsets, bake them into the object times or extract a lead-in into them, which needs -fullSong")
+	var anchors anchorList
+	fs.Var(&anchors, "anchor", "warp anchor EDITOR_BEAT=REAL_BEAT (repeatable)")
+	emitBPMChanges := fs.Bool("emitBPMChanges", false, "follow the warp anchors with BPM change markers instead of moving objects")
+	var difficulties stringList
+	fs.Var(&difficulties, "difficulty", "only convert difficulties matching CHARACTERISTIC/NAME, NAME or CHARACTERISTIC/* (repeatable)")
+	copyUnselected := fs.Bool("copyUnselected", false, "copy the difficulties that aren't converted unchanged instead of leaving them out")
+	dryRun := fs.Bool("dry-run", false, "report what the conversion would do without writing anything")
+	format := fs.String("format", "text", "report format, text or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("convert: unexpected argument '%s'", fs.Arg(0))
+	}
+	var song, editor meter
+	if *meterText != "" {
+		var err error
+		if song, err = parseMeter(*meterText); err != nil {
+			return err
+		}
+		if *editorMeterText != "" {
+			if editor, err = parseMeter(*editorMeterText); err != nil {
+				return err
+			}
+		}
+	}
+	for _, required := range []struct{ name, value string }{
+		{"inputFolder", *inputFolder},
+		{"outputFolder", *outputFolder},
+		{"inputBPM", *inputBPM},
+	} {
+		if required.value == "" {
+			return errors.New("convert: missing required flag -" + required.name)
+		}
+	}
+	// With a meter, the output BPM follows from the input BPM.
+	if *outputBPM == "" && *meterText != "" {
+		bpm, err := meterOutputBPM(*inputBPM, song, editor)
+		if err != nil {
+			return err
+		}
+		*outputBPM = bpm
+	}
+	if *outputBPM == "" {
+		return errors.New("convert: missing required flag -outputBPM (or -meter)")
+	}
+
+	songInfoPath, err := findSongInfo(*inputFolder)
+	if err != nil {
+		return err
+	}
+	inputs, err := validateInputs(songInfoPath, *outputFolder, *inputBPM, *outputBPM)
+	if err != nil {
+		return err
+	}
+	inputs.FullSong = *fullSong
+	inputs.LinkAssets = *linkAssets
+	inputs.Snap = *snap
+	inputs.Meter, inputs.EditorMeter = song, editor
+	if inputs.OffsetMode, err = parseOffsetMode(*offsetText); err != nil {
+		return fmt.Errorf("convert: -offset: %s", err)
+	}
+	inputs.Anchors = anchors
+	inputs.EmitBPMChanges = *emitBPMChanges
+	inputs.Difficulties = difficulties
+	inputs.CopyUnselected = *copyUnselected
+	inputs.DryRun = *dryRun
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("convert: unknown -format '%s'", *format)
+	}
+	if inputs.Snap < 0 {
+		return errors.New("convert: -snap must be 0 or more")
+	}
+	if inputs.EmitBPMChanges && len(inputs.Anchors) == 0 {
+		return errors.New("convert: -emitBPMChanges needs at least one -anchor")
+	}
+	ctx, cancel := interruptContext()
+	defer cancel()
+	report, err := process(ctx, inputs, nil)
+	if err != nil {
+		return err
+	}
+	return printReport(os.Stdout, *format, inputs, report)
+}
+
+// interruptContext returns a context that Ctrl-C cancels, so that an
+// interrupted conversion leaves the output folder as it was.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		select {
+		case <-interrupts:
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(interrupts)
+	}()
+	return ctx, cancel
+}
+
+func printSummary(w io.Writer, inputs *inputFields, report *conversionReport) {
+	converted := 0
+	for _, result := range report.Difficulties {
+		if !result.Copied {
+			converted++
+		}
+	}
+	verb := "converted"
+	if report.DryRun {
+		verb = "dry run, nothing written: would convert"
+	}
+	fmt.Fprintf(w, "%s %d difficulties from %s BPM to %s BPM\n", verb, converted, floatToString(inputs.InputBPM), floatToString(inputs.OutputBPM))
+	for _, result := range report.Difficulties {
+		if result.Copied {
+			fmt.Fprintf(w, "  %s: copied unchanged -> %s\n", result.Difficulty, result.OutputPath)
+			for _, warning := range result.Warnings {
+				fmt.Fprintf(w, "    warning: %s\n", warning)
+			}
+			continue
+		}
+		fmt.Fprintf(w, "  %s: %d notes, %d obstacles, %d events -> %s\n", result.Difficulty, result.Notes, result.Obstacles, result.Events, result.OutputPath)
+		if inputs.Snap > 0 {
+			fmt.Fprintf(w, "    snapped to the 1/%d beat grid, moving objects by up to %.4g beats\n", inputs.Snap, result.MaxSnapError)
+		}
+		if result.Offset != result.InputOffset {
+			fmt.Fprintf(w, "    offset %d ms -> %d ms\n", result.InputOffset, result.Offset)
+		}
+		if p := result.Preview; p != nil {
+			fmt.Fprintf(w, "    moves %d notes, %d obstacles, %d events\n", p.MovedNotes, p.MovedObstacles, p.MovedEvents)
+			fmt.Fprintf(w, "    objects from beat %s to %s, were %s to %s\n", floatToString(p.FirstAfter), floatToString(p.LastAfter), floatToString(p.FirstBefore), floatToString(p.LastBefore))
+			if p.OffGrid > 0 {
+				beats := formatBeats(p.OffGridBeats)
+				if p.OffGrid > len(p.OffGridBeats) {
+					beats += ", ..."
+				}
+				fmt.Fprintf(w, "    %d objects land off the 1/%d beat grid, at beats %s\n", p.OffGrid, previewGrid, beats)
+			}
+		}
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(w, "    warning: %s\n", warning)
+		}
+	}
+	if report.DryRun {
+		for _, file := range report.Files {
+			action := "create"
+			if file.Overwrite {
+				action = "overwrite"
+			}
+			fmt.Fprintf(w, "  would %s %s\n", action, file.Path)
+		}
+		return
+	}
+	if inputs.FullSong {
+		fmt.Fprintf(w, "song info and assets written to %s\n", inputs.OutputFolder)
+	}
+}
+
+// meterOutputBPM returns the output BPM that meterRatio gives for a song
+// charted at inputBPM.
+func meterOutputBPM(inputBPM string, song, editor meter) (string, error) {
+	bpm, err := parsePositiveRat(inputBPM)
+	if err != nil {
+		return "", fmt.Errorf("input bpm: %s", err)
+	}
+	return ratToString(bpm.Mul(bpm, meterRatio(song, editor))), nil
+}
+
+func formatBeats(beats []float64) string {
+	var fields []string
+	for _, beat := range beats {
+		fields = append(fields, strconv.FormatFloat(beat, 'f', 3, 64))
+	}
+	return strings.Join(fields, ", ")
+}
+
+// printReport prints report in the given format, "text" or "json".
+func printReport(w io.Writer, format string, inputs *inputFields, report *conversionReport) error {
+	switch format {
+	case "text":
+		printSummary(w, inputs, report)
+		return nil
+	case "json":
+		buf, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", buf)
+		return err
+	}
+	return fmt.Errorf("unknown report format '%s'", format)
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestMeterRatio(t *testing.T) {
+	tests := []struct {
+		song, editor meter
+		want         string
+	}{
+		{meter{4, 4}, meter{4, 4}, "1"},
+		{meter{3, 4}, meter{}, "1"},
+		// The eighth notes of a 6/8 song charted as beats.
+		{meter{6, 8}, meter{6, 8}, "1/3"},
+		{meter{6, 8}, meter{}, "1/3"},
+		{meter{12, 8}, meter{12, 8}, "1/3"},
+		// The quarter notes of a 6/8 song charted as beats.
+		{meter{6, 8}, meter{4, 4}, "2/3"},
+		{meter{2, 2}, meter{4, 4}, "1/2"},
+		{meter{3, 8}, meter{3, 8}, "1"},
+	}
+	for _, test := range tests {
+		if got := meterRatio(test.song, test.editor).RatString(); got != test.want {
+			t.Errorf("meterRatio(%v, %v) = %s, want %s", test.song, test.editor, got, test.want)
+		}
+	}
+}
+
+func TestMeterOutputBPM(t *testing.T) {
+	tests := []struct {
+		inputBPM     string
+		song, editor meter
+		want         string
+	}{
+		{"360", meter{6, 8}, meter{}, "120"},
+		{"360", meter{6, 8}, meter{4, 4}, "240"},
+		{"100", meter{9, 8}, meter{9, 8}, "100/3"},
+		{"120", meter{4, 4}, meter{}, "120"},
+	}
+	for _, test := range tests {
+		got, err := meterOutputBPM(test.inputBPM, test.song, test.editor)
+		if err != nil {
+			t.Errorf("meterOutputBPM(%s, %v, %v): %s", test.inputBPM, test.song, test.editor, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("meterOutputBPM(%s, %v, %v) = %s, want %s", test.inputBPM, test.song, test.editor, got, test.want)
+		}
+	}
+	if _, err := meterOutputBPM("0", meter{6, 8}, meter{}); err == nil {
+		t.Error("meterOutputBPM accepted an input BPM of 0")
+	}
+}
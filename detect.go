@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/cmplx"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The onset envelope is measured on frames of onsetFrame samples, every
+// onsetHop samples.
+const (
+	onsetFrame = 1024
+	onsetHop   = 512
+)
+
+// lowBandHz is where onsetEnvelope's low band ends. Kick drums and bass,
+// which mark the beat rather than the off-beat, are below it.
+const lowBandHz = 150
+
+// onsetEnvelope measures how strongly a new sound starts in each frame of a,
+// as the spectral flux: how much louder each frequency got than in the frame
+// before. It returns the envelope over every frequency and over the low band
+// only, and how many frames there are per second. Frame i is centered on
+// sample i*onsetHop + onsetFrame/2.
+func onsetEnvelope(a *audio) (all, low []float64, fps float64) {
+	window := make([]float64, onsetFrame)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/onsetFrame)
+	}
+	frames := (len(a.samples) - onsetFrame) / onsetHop
+	if frames < 0 {
+		frames = 0
+	}
+	lowBins := lowBandHz * onsetFrame / a.sampleRate
+	all, low = make([]float64, frames), make([]float64, frames)
+	spectrum := make([]complex128, onsetFrame)
+	previous := make([]float64, onsetFrame/2)
+	for frame := 0; frame < frames; frame++ {
+		start := frame * onsetHop
+		for i := range spectrum {
+			spectrum[i] = complex(float64(a.samples[start+i])*window[i], 0)
+		}
+		fft(spectrum)
+		for k := range previous {
+			// Log compression keeps loud drums from drowning out
+			// everything else.
+			magnitude := math.Log1p(100 * cmplx.Abs(spectrum[k]))
+			if frame > 0 && magnitude > previous[k] {
+				all[frame] += magnitude - previous[k]
+				if k <= lowBins {
+					low[frame] += magnitude - previous[k]
+				}
+			}
+			previous[k] = magnitude
+		}
+	}
+	fps = float64(a.sampleRate) / onsetHop
+	return standOut(all, int(fps/4)), standOut(low, int(fps/4)), fps
+}
+
+// standOut keeps only how far each value of flux rises above the average
+// of the values within radius of it, since only what stands out from its
+// surroundings counts as an onset.
+func standOut(flux []float64, radius int) []float64 {
+	prefix := make([]float64, len(flux)+1)
+	for i, f := range flux {
+		prefix[i+1] = prefix[i] + f
+	}
+	envelope := make([]float64, len(flux))
+	for i := range envelope {
+		lo, hi := i-radius, i+radius+1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(flux) {
+			hi = len(flux)
+		}
+		envelope[i] = math.Max(0, flux[i]-(prefix[hi]-prefix[lo])/float64(hi-lo))
+	}
+	return envelope
+}
+
+// fft is an in-place radix-2 fast Fourier transform. len(x) must be a power
+// of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even, odd := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = even+odd, even-odd
+				w *= step
+			}
+		}
+	}
+}
+
+// The tempos detectTempo looks for.
+const (
+	minDetectBPM = 60
+	maxDetectBPM = 240
+)
+
+// maxTempoCandidates limits how many tempos detectTempo returns.
+const maxTempoCandidates = 5
+
+// tempoCandidate is a tempo that detectTempo found.
+type tempoCandidate struct {
+	BPM float64
+	// FirstBeat is the time in seconds of the first beat of the song at
+	// this tempo.
+	FirstBeat float64
+	Score     float64
+	// Confidence is the candidate's share of the scores of all candidates.
+	Confidence float64
+}
+
+// detectTempo estimates the tempo of a. It finds the beat lengths at which
+// the onset envelope repeats best, then refines each one against the whole
+// song, so that a constant tempo comes out within a hundredth of a BPM or
+// so. The best candidate comes first.
+func detectTempo(a *audio) ([]tempoCandidate, error) {
+	envelope, low, fps := onsetEnvelope(a)
+	minLag := int(math.Floor(fps * 60 / maxDetectBPM))
+	maxLag := int(math.Ceil(fps * 60 / minDetectBPM))
+	// The search below looks at the lags either side of each one, and
+	// refines a peak between them, so the fastest beat must be two frames
+	// or more long.
+	if minLag < 2 {
+		return nil, fmt.Errorf("a sample rate of %d Hz is too low to detect a tempo", a.sampleRate)
+	}
+	if len(envelope) < 2*maxLag {
+		return nil, errors.New("too short to detect a tempo")
+	}
+
+	correlation := make([]float64, maxLag+2)
+	for lag := minLag - 1; lag <= maxLag+1; lag++ {
+		for i := 0; i+lag < len(envelope); i++ {
+			correlation[lag] += envelope[i] * envelope[i+lag]
+		}
+		correlation[lag] /= float64(len(envelope) - lag)
+	}
+	var peaks []int
+	for lag := minLag; lag <= maxLag; lag++ {
+		if correlation[lag] > correlation[lag-1] && correlation[lag] >= correlation[lag+1] {
+			peaks = append(peaks, lag)
+		}
+	}
+	if len(peaks) == 0 {
+		return nil, errors.New("no beat found")
+	}
+	sort.Slice(peaks, func(i, j int) bool { return correlation[peaks[i]] > correlation[peaks[j]] })
+	if len(peaks) > maxTempoCandidates {
+		peaks = peaks[:maxTempoCandidates]
+	}
+
+	var candidates []tempoCandidate
+	total := 0.0
+	for _, lag := range peaks {
+		// The true beat length is somewhere between the neighbouring lags.
+		bpm, _ := refineTempo(envelope, fps, 60*fps/float64(lag+1), 60*fps/float64(lag-1), 0.1)
+		bpm, fit := refineTempo(envelope, fps, bpm-0.1, bpm+0.1, 0.005)
+		phase := beatPhase(envelope, low, 60*fps/bpm)
+		candidate := tempoCandidate{
+			BPM:       bpm,
+			FirstBeat: phase/fps + onsetFrame/2/float64(a.sampleRate),
+			Score:     fit * tempoFit(bpm),
+		}
+		total += candidate.Score
+		candidates = append(candidates, candidate)
+	}
+	if total == 0 {
+		return nil, errors.New("no beat found")
+	}
+	for i := range candidates {
+		candidates[i].Confidence = candidates[i].Score / total
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+	return candidates, nil
+}
+
+// refineTempo tries every tempo from lo to hi BPM in steps of step, and
+// returns the one whose beats, at the best phase, line up with the
+// strongest onsets, with how well it fits.
+func refineTempo(envelope []float64, fps, lo, hi, step float64) (bpm, fit float64) {
+	for candidate := lo; candidate <= hi; candidate += step {
+		period := 60 * fps / candidate
+		for offset := 0.0; offset < period; offset += 0.25 {
+			if score := combScore(envelope, period, offset); score > fit {
+				bpm, fit = candidate, score
+			}
+		}
+	}
+	return bpm, fit
+}
+
+// beatPhase returns the offset, in frames, of the beat grid with the given
+// period. Hi-hats on the off-beat often make the strongest onsets of all, so
+// the grid is lined up with the low band, where kick drums and bass mark the
+// beat, unless the song has nothing there.
+func beatPhase(all, low []float64, period float64) float64 {
+	envelope := low
+	if average(low) == 0 {
+		envelope = all
+	}
+	phase, best := 0.0, 0.0
+	for offset := 0.0; offset < period; offset += 0.25 {
+		if score := combScore(envelope, period, offset); score > best {
+			phase, best = offset, score
+		}
+	}
+	return phase
+}
+
+func average(values []float64) float64 {
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	return sum / float64(len(values))
+}
+
+// combScore is the average onset strength on the beats of a grid with the
+// given period and offset, in frames.
+func combScore(envelope []float64, period, offset float64) float64 {
+	sum, beats := 0.0, 0
+	for position := offset; position < float64(len(envelope)-1); position += period {
+		i := int(position)
+		fraction := position - float64(i)
+		sum += envelope[i]*(1-fraction) + envelope[i+1]*fraction
+		beats++
+	}
+	if beats == 0 {
+		return 0
+	}
+	return sum / float64(beats)
+}
+
+// audioPathForFolder returns the audio file of the song in folder.
+func audioPathForFolder(folder string) (string, error) {
+	songInfo, err := loadSongInfo(folder)
+	if err != nil {
+		return "", err
+	}
+	for _, difficultyLevel := range songInfo.Difficulties() {
+		if difficultyLevel.AudioPath != "" {
+			return songPath(folder, difficultyLevel.AudioPath)
+		}
+	}
+	return "", fmt.Errorf("song '%s': no audio file", folder)
+}
+
+// detectFolderTempo estimates the tempo of the song in folder from its
+// audio.
+func detectFolderTempo(folder string) (string, []tempoCandidate, error) {
+	audioPath, err := audioPathForFolder(folder)
+	if err != nil {
+		return "", nil, err
+	}
+	a, err := loadAudio(audioPath)
+	if err != nil {
+		return "", nil, err
+	}
+	candidates, err := detectTempo(a)
+	if err != nil {
+		return "", nil, fmt.Errorf("audio '%s': %s", audioPath, err)
+	}
+	return audioPath, candidates, nil
+}
+
+func printTempoCandidates(w io.Writer, audioPath string, candidates []tempoCandidate) {
+	fmt.Fprintf(w, "tempo of %s: %.2f BPM, first beat at %.3fs, confidence %.0f%%\n", audioPath, candidates[0].BPM, candidates[0].FirstBeat, candidates[0].Confidence*100)
+	for _, candidate := range candidates {
+		fmt.Fprintf(w, "  %7.2f BPM  first beat at %6.3fs  %3.0f%%\n", candidate.BPM, candidate.FirstBeat, candidate.Confidence*100)
+	}
+}
+
+// runDetect handles the "detect" subcommand.
+func runDetect(args []string) error {
+	fs := flag.NewFlagSet("detect", flag.ContinueOnError)
+	inputFolder := fs.String("inputFolder", "", "song folder whose audio to analyze")
+	audioFile := fs.String("audio", "", "OGG Vorbis or WAV file to analyze instead of a song folder's audio")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("detect: unexpected argument '%s'", fs.Arg(0))
+	}
+	if (*inputFolder == "") == (*audioFile == "") {
+		return errors.New("detect: pass either -inputFolder or -audio")
+	}
+	if *audioFile != "" {
+		a, err := loadAudio(*audioFile)
+		if err != nil {
+			return err
+		}
+		candidates, err := detectTempo(a)
+		if err != nil {
+			return fmt.Errorf("audio '%s': %s", *audioFile, err)
+		}
+		printTempoCandidates(os.Stdout, *audioFile, candidates)
+		return nil
+	}
+	audioPath, candidates, err := detectFolderTempo(filepath.Clean(*inputFolder))
+	if err != nil {
+		return err
+	}
+	printTempoCandidates(os.Stdout, audioPath, candidates)
+	return nil
+}
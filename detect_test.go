@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// clickTrack returns seconds of a kick drum on every beat at bpm, starting
+// at first seconds, with a little noise under it.
+func clickTrack(bpm, first, seconds float64, sampleRate int) *audio {
+	a := &audio{samples: make([]float32, int(seconds*float64(sampleRate))), sampleRate: sampleRate}
+	random := rand.New(rand.NewSource(1))
+	for i := range a.samples {
+		a.samples[i] = float32(random.NormFloat64() * 0.01)
+	}
+	for beat := first; beat < seconds; beat += 60 / bpm {
+		start := int(beat * float64(sampleRate))
+		for i := 0; i < sampleRate/10 && start+i < len(a.samples); i++ {
+			t := float64(i) / float64(sampleRate)
+			a.samples[start+i] += float32(0.8 * math.Sin(2*math.Pi*60*t) * math.Exp(-t/0.03))
+		}
+	}
+	return a
+}
+
+func TestDetectTempo(t *testing.T) {
+	for _, test := range []struct {
+		bpm, first float64
+	}{
+		{120, 0.5},
+		{174, 0.25},
+	} {
+		candidates, err := detectTempo(clickTrack(test.bpm, test.first, 30, 22050))
+		if err != nil {
+			t.Errorf("%v BPM: %s", test.bpm, err)
+			continue
+		}
+		best := candidates[0]
+		if math.Abs(best.BPM-test.bpm) > 0.05 {
+			t.Errorf("%v BPM: detected %.3f BPM", test.bpm, best.BPM)
+		}
+		// The first beat found may be any beat, so only its phase counts.
+		beat := 60 / test.bpm
+		phase := math.Mod(best.FirstBeat-test.first+beat/2, beat) - beat/2
+		if math.Abs(phase) > 0.02 {
+			t.Errorf("%v BPM: first beat at %.3fs, off the beat by %.3fs", test.bpm, best.FirstBeat, phase)
+		}
+	}
+}
+
+func TestDetectTempoLowSampleRate(t *testing.T) {
+	// Below 4096 Hz the fastest beat is less than two onset frames long.
+	for _, sampleRate := range []int{1000, 2048, 3000} {
+		if _, err := detectTempo(clickTrack(120, 0, 60, sampleRate)); err == nil {
+			t.Errorf("%d Hz: no error", sampleRate)
+		}
+	}
+	if _, err := detectTempo(clickTrack(120, 0.5, 60, 8000)); err != nil {
+		t.Errorf("8000 Hz: %s", err)
+	}
+}
+
+// encodeWAV writes samples as a 16 bit PCM WAV file with the same samples
+// on every channel.
+func encodeWAV(samples []float32, sampleRate, channels int) []byte {
+	var data bytes.Buffer
+	for _, sample := range samples {
+		for c := 0; c < channels; c++ {
+			binary.Write(&data, binary.LittleEndian, int16(sample*(1<<15-1)))
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+data.Len()))
+	buf.WriteString("WAVEfmt ")
+	for _, field := range []interface{}{
+		uint32(16), uint16(wavPCM), uint16(channels), uint32(sampleRate),
+		uint32(sampleRate * channels * 2), uint16(channels * 2), uint16(16),
+	} {
+		binary.Write(&buf, binary.LittleEndian, field)
+	}
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(data.Len()))
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+func TestDecodeWAV(t *testing.T) {
+	samples := []float32{0, 0.5, -0.5, 0.25}
+	a, err := decodeWAV(encodeWAV(samples, 8000, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.sampleRate != 8000 {
+		t.Errorf("sample rate %d, want 8000", a.sampleRate)
+	}
+	if len(a.samples) != len(samples) {
+		t.Fatalf("%d samples, want %d", len(a.samples), len(samples))
+	}
+	for i, sample := range samples {
+		if math.Abs(float64(a.samples[i]-sample)) > 1e-4 {
+			t.Errorf("sample %d is %v, want %v", i, a.samples[i], sample)
+		}
+	}
+
+	if _, err := decodeWAV(encodeWAV(samples, 8000, 0)); err == nil {
+		t.Error("no error for a WAV without channels")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+// Event box groups hold most of the lightshow in v3.x difficulties. A group
+// sits at an absolute beat, and everything inside it is measured in beats
+// relative to that: the events themselves, and the beat distribution "w"
+// that spreads them across the lights in a box (the total length for wave
+// distribution, the gap between lights for step distribution). All of those
+// are converted as durations starting at the group's beat, so the lights
+// fire at the same moments in seconds after a BPM change.
+
+// LightEventBoxGroup is an entry of lightColorEventBoxGroups,
+// lightRotationEventBoxGroups or lightTranslationEventBoxGroups.
+type LightEventBoxGroup struct {
+	Beat  float64         `json:"b"`
+	Boxes []LightEventBox `json:"e"`
+
+	raw rawObject
+}
+
+// LightEventBox keeps its events under "e" in color groups and under "l" in
+// rotation and translation groups.
+type LightEventBox struct {
+	BeatDistribution float64      `json:"w"`
+	ColorEvents      []BeatObject `json:"e"`
+	Events           []BeatObject `json:"l"`
+
+	raw rawObject
+}
+
+// VFXEventBoxGroup is an entry of vfxEventBoxGroups. Its boxes refer to
+// events in the difficulty's _fxEventsCollection by index instead of
+// holding them directly.
+type VFXEventBoxGroup struct {
+	Beat  float64       `json:"b"`
+	Boxes []VFXEventBox `json:"e"`
+
+	raw rawObject
+}
+
+type VFXEventBox struct {
+	BeatDistribution float64 `json:"w"`
+	EventIndices     []int   `json:"l"`
+
+	raw rawObject
+}
+
+type FXEventsCollection struct {
+	FloatEvents []BeatObject `json:"_fl"`
+
+	raw rawObject
+}
+
+func rescaleLightEventBoxGroups(groups []LightEventBoxGroup, c beatConverter) {
+	for i, group := range groups {
+		for j, box := range group.Boxes {
+			group.Boxes[j].BeatDistribution = c.Duration(group.Beat, box.BeatDistribution)
+			for _, events := range [][]BeatObject{box.ColorEvents, box.Events} {
+				for k, event := range events {
+					events[k].Beat = c.Duration(group.Beat, event.Beat)
+				}
+			}
+		}
+		groups[i].Beat = c.Beat(group.Beat)
+	}
+}
+
+// sharedData hands out converted values for data entries that several
+// objects refer to by index. An entry only keeps a single value if every
+// object converts it the same way; otherwise objects that need another value
+// get a copy of the entry, which they share with any other object that
+// converts it to that value, so each one stays in time.
+type sharedData struct {
+	// assigned maps each original index and converted value to the index
+	// of the entry that holds it.
+	assigned map[int]map[float64]int
+	// set stores value in the entry at index.
+	set func(index int, value float64)
+	// clone appends a copy of the entry at index and returns the copy's index.
+	clone func(index int) int
+}
+
+func newSharedData(set func(int, float64), clone func(int) int) *sharedData {
+	return &sharedData{assigned: map[int]map[float64]int{}, set: set, clone: clone}
+}
+
+// use records that an object refers to index with the converted value and
+// returns the index the object should refer to from now on.
+func (d *sharedData) use(index int, value float64) int {
+	values, seen := d.assigned[index]
+	if !seen {
+		values = map[float64]int{}
+		d.assigned[index] = values
+	}
+	if copied, ok := values[value]; ok {
+		return copied
+	}
+	if seen {
+		index = d.clone(index)
+	}
+	d.set(index, value)
+	values[value] = index
+	return index
+}
+
+// rescaleVFXEventBoxGroups converts the vfx groups along with the shared
+// events they point at.
+func rescaleVFXEventBoxGroups(groups []VFXEventBoxGroup, fx *FXEventsCollection, c beatConverter) {
+	originalBeats := make([]float64, len(fx.FloatEvents))
+	for i, event := range fx.FloatEvents {
+		originalBeats[i] = event.Beat
+	}
+	events := newSharedData(func(index int, beat float64) {
+		fx.FloatEvents[index].Beat = beat
+	}, func(index int) int {
+		fx.FloatEvents = append(fx.FloatEvents, fx.FloatEvents[index])
+		return len(fx.FloatEvents) - 1
+	})
+	for i, group := range groups {
+		for j, box := range group.Boxes {
+			group.Boxes[j].BeatDistribution = c.Duration(group.Beat, box.BeatDistribution)
+			for k, index := range box.EventIndices {
+				if index < 0 || index >= len(originalBeats) {
+					continue
+				}
+				box.EventIndices[k] = events.use(index, c.Duration(group.Beat, originalBeats[index]))
+			}
+		}
+		groups[i].Beat = c.Beat(group.Beat)
+	}
+}
+
+// appendLightEventBeats appends the absolute beat of every event in groups.
+func appendLightEventBeats(beats []float64, groups []LightEventBoxGroup) []float64 {
+	for _, group := range groups {
+		for _, box := range group.Boxes {
+			for _, events := range [][]BeatObject{box.ColorEvents, box.Events} {
+				for _, event := range events {
+					beats = append(beats, group.Beat+event.Beat)
+				}
+			}
+		}
+	}
+	return beats
+}
+
+func countLightEvents(groups []LightEventBoxGroup) int {
+	count := 0
+	for _, group := range groups {
+		for _, box := range group.Boxes {
+			count += len(box.ColorEvents) + len(box.Events)
+		}
+	}
+	return count
+}
+
+func (g *LightEventBoxGroup) UnmarshalJSON(data []byte) error {
+	type lightEventBoxGroup LightEventBoxGroup
+	return unmarshalObject(data, (*lightEventBoxGroup)(g), &g.raw)
+}
+
+func (g LightEventBoxGroup) MarshalJSON() ([]byte, error) {
+	type lightEventBoxGroup LightEventBoxGroup
+	return marshalObject(lightEventBoxGroup(g), g.raw)
+}
+
+func (b *LightEventBox) UnmarshalJSON(data []byte) error {
+	type lightEventBox LightEventBox
+	return unmarshalObject(data, (*lightEventBox)(b), &b.raw)
+}
+
+func (b LightEventBox) MarshalJSON() ([]byte, error) {
+	type lightEventBox LightEventBox
+	return marshalObject(lightEventBox(b), b.raw)
+}
+
+func (g *VFXEventBoxGroup) UnmarshalJSON(data []byte) error {
+	type vfxEventBoxGroup VFXEventBoxGroup
+	return unmarshalObject(data, (*vfxEventBoxGroup)(g), &g.raw)
+}
+
+func (g VFXEventBoxGroup) MarshalJSON() ([]byte, error) {
+	type vfxEventBoxGroup VFXEventBoxGroup
+	return marshalObject(vfxEventBoxGroup(g), g.raw)
+}
+
+func (b *VFXEventBox) UnmarshalJSON(data []byte) error {
+	type vfxEventBox VFXEventBox
+	return unmarshalObject(data, (*vfxEventBox)(b), &b.raw)
+}
+
+func (b VFXEventBox) MarshalJSON() ([]byte, error) {
+	type vfxEventBox VFXEventBox
+	return marshalObject(vfxEventBox(b), b.raw)
+}
+
+func (f *FXEventsCollection) UnmarshalJSON(data []byte) error {
+	type fxEventsCollection FXEventsCollection
+	return unmarshalObject(data, (*fxEventsCollection)(f), &f.raw)
+}
+
+func (f FXEventsCollection) MarshalJSON() ([]byte, error) {
+	type fxEventsCollection FXEventsCollection
+	return marshalObject(fxEventsCollection(f), f.raw)
+}
@@ -0,0 +1,111 @@
+package main
+
+import "fmt"
+
+// SongInfoV2 is the Info.dat layout used by the game since 1.0, where the
+// difficulties are grouped by characteristic and each one points at a .dat
+// beatmap file.
+type SongInfoV2 struct {
+	Version               string                 `json:"_version"`
+	SongName              string                 `json:"_songName"`
+	SongSubName           string                 `json:"_songSubName"`
+	SongAuthorName        string                 `json:"_songAuthorName"`
+	LevelAuthorName       string                 `json:"_levelAuthorName"`
+	BeatsPerMinute        float64                `json:"_beatsPerMinute"`
+	SongTimeOffset        float64                `json:"_songTimeOffset"`
+	Shuffle               float64                `json:"_shuffle"`
+	ShufflePeriod         float64                `json:"_shufflePeriod"`
+	PreviewStartTime      float64                `json:"_previewStartTime"`
+	PreviewDuration       float64                `json:"_previewDuration"`
+	SongFilename          string                 `json:"_songFilename"`
+	CoverImageFilename    string                 `json:"_coverImageFilename"`
+	EnvironmentName       string                 `json:"_environmentName"`
+	DifficultyBeatmapSets []DifficultyBeatmapSet `json:"_difficultyBeatmapSets"`
+
+	raw rawObject
+}
+
+type DifficultyBeatmapSet struct {
+	BeatmapCharacteristicName string              `json:"_beatmapCharacteristicName"`
+	DifficultyBeatmaps        []DifficultyBeatmap `json:"_difficultyBeatmaps"`
+
+	raw rawObject
+}
+
+type DifficultyBeatmap struct {
+	Difficulty              string  `json:"_difficulty"`
+	DifficultyRank          int     `json:"_difficultyRank"`
+	BeatmapFilename         string  `json:"_beatmapFilename"`
+	NoteJumpMovementSpeed   float64 `json:"_noteJumpMovementSpeed"`
+	NoteJumpStartBeatOffset float64 `json:"_noteJumpStartBeatOffset"`
+
+	raw rawObject
+}
+
+func (s *SongInfoV2) FileName() string      { return "Info.dat" }
+func (s *SongInfoV2) BPM() float64          { return s.BeatsPerMinute }
+func (s *SongInfoV2) SetBPM(bpm float64)    { s.BeatsPerMinute = bpm }
+func (s *SongInfoV2) AudioDataPath() string { return "" }
+
+func (s *SongInfoV2) Assets() []string {
+	return []string{s.SongFilename, s.CoverImageFilename}
+}
+
+func (s *SongInfoV2) Difficulties() []difficulty {
+	var difficulties []difficulty
+	for _, set := range s.DifficultyBeatmapSets {
+		for _, beatmap := range set.DifficultyBeatmaps {
+			difficulties = append(difficulties, difficulty{
+				Characteristic: set.BeatmapCharacteristicName,
+				Name:           beatmap.Difficulty,
+				BeatmapPath:    beatmap.BeatmapFilename,
+				AudioPath:      s.SongFilename,
+			})
+		}
+	}
+	return difficulties
+}
+
+// SetOffset fails unless the offset stays 0, since v2 difficulties have no
+// offset of their own.
+func (s *SongInfoV2) SetOffset(d difficulty, offset int) error {
+	if offset != 0 {
+		return fmt.Errorf("difficulty %s: Info.dat v2 has no per-difficulty offset", d)
+	}
+	return nil
+}
+
+// SetLightshowPath fails, since v2 difficulties have no lightshow files.
+func (s *SongInfoV2) SetLightshowPath(d difficulty, relativePath string) error {
+	return fmt.Errorf("difficulty %s: Info.dat v2 has no lightshow files", d)
+}
+
+func (s *SongInfoV2) UnmarshalJSON(data []byte) error {
+	type songInfoV2 SongInfoV2
+	return unmarshalObject(data, (*songInfoV2)(s), &s.raw)
+}
+
+func (s SongInfoV2) MarshalJSON() ([]byte, error) {
+	type songInfoV2 SongInfoV2
+	return marshalObject(songInfoV2(s), s.raw)
+}
+
+func (d *DifficultyBeatmapSet) UnmarshalJSON(data []byte) error {
+	type difficultyBeatmapSet DifficultyBeatmapSet
+	return unmarshalObject(data, (*difficultyBeatmapSet)(d), &d.raw)
+}
+
+func (d DifficultyBeatmapSet) MarshalJSON() ([]byte, error) {
+	type difficultyBeatmapSet DifficultyBeatmapSet
+	return marshalObject(difficultyBeatmapSet(d), d.raw)
+}
+
+func (d *DifficultyBeatmap) UnmarshalJSON(data []byte) error {
+	type difficultyBeatmap DifficultyBeatmap
+	return unmarshalObject(data, (*difficultyBeatmap)(d), &d.raw)
+}
+
+func (d DifficultyBeatmap) MarshalJSON() ([]byte, error) {
+	type difficultyBeatmap DifficultyBeatmap
+	return marshalObject(difficultyBeatmap(d), d.raw)
+}
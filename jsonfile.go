@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// decodeFile decodes the contents of filePath into v. Errors name the file
+// and, where encoding/json knows it, the line and column of the problem.
+func decodeFile(filePath string, data []byte, v interface{}) error {
+	err := json.Unmarshal(data, v)
+	if err == nil {
+		return nil
+	}
+	offset := int64(-1)
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+	case *nestedError:
+		// Decoding stops at the first bad object, so the first copy of its
+		// bytes in the file is the one that failed.
+		if start := bytes.Index(data, e.data); start >= 0 {
+			offset = int64(start) + e.offset
+		}
+		err = e.err
+	}
+	if offset < 0 {
+		return fmt.Errorf("%s: %s", filePath, err)
+	}
+	line, column := position(data, offset)
+	return fmt.Errorf("%s:%d:%d: %s", filePath, line, column, err)
+}
+
+// nestedError is a type error from inside an UnmarshalJSON method, whose
+// offset is only relative to the object that method was given.
+type nestedError struct {
+	data   []byte
+	offset int64
+	err    error
+}
+
+func (e *nestedError) Error() string { return e.err.Error() }
+
+// wrapNestedError keeps track of where a type error happened in data. Errors
+// from deeper down already know and are passed through.
+func wrapNestedError(data []byte, err error) error {
+	if e, ok := err.(*json.UnmarshalTypeError); ok {
+		return &nestedError{data: data, offset: e.Offset, err: err}
+	}
+	return err
+}
+
+// position turns a byte offset into a 1-based line and column.
+func position(data []byte, offset int64) (line, column int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line = bytes.Count(before, []byte("\n")) + 1
+	column = len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// checkBeatmap returns warnings about a beatmap that parsed but looks wrong,
+// such as one that was cut short or isn't a beatmap at all.
+func checkBeatmap(beatMap beatmapFile) []string {
+	var warnings []string
+	if notes, _, _ := beatMap.Counts(); notes == 0 {
+		warnings = append(warnings, "no notes")
+	}
+	if b, ok := beatMap.(*BeatMap); ok && !b.raw.has("_version") {
+		warnings = append(warnings, "no _version")
+	}
+	return warnings
+}
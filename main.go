@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"math"
+	"math/big"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/shibukawa/configdir"
 
@@ -19,12 +25,28 @@ import (
 func main() {
 	if err := run(); err != nil {
 		fmt.Println("ERROR:", err)
+		os.Exit(1)
 	}
 }
 
 var configDirs = configdir.New("", "bpm-saber")
 
 func run() error {
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		return runConvert(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		return runRestore(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "batch" {
+		return runBatch(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "suggest" {
+		return runSuggest(os.Args[2:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == "detect" {
+		return runDetect(os.Args[2:])
+	}
 	cliInputs := getInput()
 
 	err := ui.Main(func() {
@@ -32,7 +54,9 @@ func run() error {
 
 		inputSongInfoEntry := ui.NewEntry()
 		if cliInputs.InputFolder != "" {
-			inputSongInfoEntry.SetText(filepath.Join(cliInputs.InputFolder, "info.json"))
+			if songInfoPath, err := findSongInfo(cliInputs.InputFolder); err == nil {
+				inputSongInfoEntry.SetText(songInfoPath)
+			}
 		}
 
 		inputSongInfoButton := ui.NewButton("Browse")
@@ -53,13 +77,45 @@ func run() error {
 			}
 			outputFolderEntry.SetText(filepath.Join(filepath.Dir(filepath.Dir(inputSongInfoEntry.Text())), "OUTPUT_FOLDER_NAME"))
 		}
+		// The difficulty list is rebuilt from whichever song info is
+		// entered, with the last selection checked.
+		difficultiesBox := ui.NewVerticalBox()
+		var difficulties []difficulty
+		var difficultyCheckboxes []*ui.Checkbox
+		loadDifficulties := func() {
+			for _, checkbox := range difficultyCheckboxes {
+				difficultiesBox.Delete(0)
+				checkbox.Destroy()
+			}
+			difficulties, difficultyCheckboxes = nil, nil
+			if validateSongInfo(inputSongInfoEntry.Text()) != nil {
+				return
+			}
+			songInfo, err := loadSongInfo(filepath.Dir(inputSongInfoEntry.Text()))
+			if err != nil {
+				return
+			}
+			for _, d := range songInfo.Difficulties() {
+				checkbox := ui.NewCheckbox(d.String())
+				checkbox.SetChecked(isSelected(cliInputs, d))
+				difficultiesBox.Append(checkbox, false)
+				difficulties = append(difficulties, d)
+				difficultyCheckboxes = append(difficultyCheckboxes, checkbox)
+			}
+		}
+		copyUnselectedCheckbox := ui.NewCheckbox("copy unselected difficulties unchanged (otherwise they are left out)")
+		copyUnselectedCheckbox.SetChecked(cliInputs.CopyUnselected)
+
 		inputSongInfoButton.OnClicked(func(btn *ui.Button) {
 			inputSongInfoEntry.SetText(ui.OpenFile(window))
 			updateOutputFolder()
+			loadDifficulties()
 		})
 		inputSongInfoEntry.OnChanged(func(e *ui.Entry) {
 			updateOutputFolder()
+			loadDifficulties()
 		})
+		loadDifficulties()
 
 		inputBpmEntry := ui.NewEntry()
 		if cliInputs.InputBPM != 0 {
@@ -88,6 +144,14 @@ func run() error {
 		if cliInputs.OutputBPM != 0 {
 			outputBpmEntry.SetText(floatToString(cliInputs.OutputBPM))
 		}
+		// An output BPM like 200/3 is shown as the fraction it was entered
+		// as, rather than rounded.
+		if cliInputs.Ratio != nil && cliInputs.InputBPM != 0 {
+			outputBPM := new(big.Rat).Mul(new(big.Rat).SetFloat64(cliInputs.InputBPM), cliInputs.Ratio)
+			if f, _ := outputBPM.Float64(); f == cliInputs.OutputBPM {
+				outputBpmEntry.SetText(ratToString(outputBPM))
+			}
+		}
 		loadOutputBpmButton := ui.NewButton("load from output folder")
 		loadOutputBpmButton.OnClicked(func(btn *ui.Button) {
 			validateOutputFolder(outputFolderEntry.Text())
@@ -98,27 +162,164 @@ func run() error {
 			}
 			outputBpmEntry.SetText(floatToString(bpm))
 		})
+		// Decoding the audio takes a moment, so it is done in the
+		// background like a conversion.
+		detectOutputBpmButton := ui.NewButton("detect from audio")
+		detectOutputBpmButton.OnClicked(func(btn *ui.Button) {
+			if err := validateSongInfo(inputSongInfoEntry.Text()); err != nil {
+				ui.MsgBoxError(window, "error", err.Error())
+				return
+			}
+			folder := filepath.Dir(inputSongInfoEntry.Text())
+			btn.Disable()
+			go func() {
+				audioPath, candidates, err := detectFolderTempo(folder)
+				ui.QueueMain(func() {
+					btn.Enable()
+					if err != nil {
+						ui.MsgBoxError(window, "error", "couldn't detect the tempo: "+err.Error())
+						return
+					}
+					outputBpmEntry.SetText(floatToString(math.Round(candidates[0].BPM*100) / 100))
+					summary := &bytes.Buffer{}
+					printTempoCandidates(summary, audioPath, candidates)
+					ui.MsgBox(window, "detected tempo", summary.String())
+				})
+			}()
+		})
 
 		multiplyButton.OnClicked(func(btn *ui.Button) {
-			inputBPM, err := parsePositiveFloat(inputBpmEntry.Text())
+			inputBPM, err := parsePositiveRat(inputBpmEntry.Text())
+			if err != nil {
+				ui.MsgBoxError(window, "Error", "invalid input BPM '"+inputBpmEntry.Text()+"'")
+				return
+			}
+			ratio := big.NewRat(int64(numerator.Value()), int64(denominator.Value()))
+			outputBpmEntry.SetText(ratToString(inputBPM.Mul(inputBPM, ratio)))
+		})
+		// The meter calculator fills in the ratio from the song's real time
+		// signature and the one the editor assumed.
+		realMeterEntry := ui.NewEntry()
+		if cliInputs.Meter.Count > 0 {
+			realMeterEntry.SetText(cliInputs.Meter.String())
+		}
+		editorMeterEntry := ui.NewEntry()
+		if cliInputs.EditorMeter.Count > 0 {
+			editorMeterEntry.SetText(cliInputs.EditorMeter.String())
+		}
+		meterButton := ui.NewButton("=")
+		meterButton.OnClicked(func(btn *ui.Button) {
+			inputBPM, err := parsePositiveRat(inputBpmEntry.Text())
 			if err != nil {
 				ui.MsgBoxError(window, "Error", "invalid input BPM '"+inputBpmEntry.Text()+"'")
 				return
 			}
-			outputBpmEntry.SetText(floatToString(inputBPM * float64(numerator.Value()) / float64(denominator.Value())))
+			song, err := parseMeter(realMeterEntry.Text())
+			if err != nil {
+				ui.MsgBoxError(window, "Error", err.Error())
+				return
+			}
+			// Without an editor meter, the song was charted in its own.
+			var editor meter
+			if editorMeterEntry.Text() != "" {
+				if editor, err = parseMeter(editorMeterEntry.Text()); err != nil {
+					ui.MsgBoxError(window, "Error", err.Error())
+					return
+				}
+			}
+			ratio := meterRatio(song, editor)
+			numerator.SetValue(int(ratio.Num().Int64()))
+			denominator.SetValue(int(ratio.Denom().Int64()))
+			outputBpmEntry.SetText(ratToString(inputBPM.Mul(inputBPM, ratio)))
+		})
+		// suggestButton fills in the calculator and the output BPM from
+		// where the notes of the input song sit.
+		suggestButton := ui.NewButton("suggest from notes")
+		suggestButton.OnClicked(func(btn *ui.Button) {
+			if err := validateSongInfo(inputSongInfoEntry.Text()); err != nil {
+				ui.MsgBoxError(window, "error", err.Error())
+				return
+			}
+			folder := filepath.Dir(inputSongInfoEntry.Text())
+			if inputBpmEntry.Text() == "" {
+				bpm, err := loadBpmFromFolder(folder)
+				if err != nil {
+					ui.MsgBoxError(window, "error", "couldn't load bpm from song info '"+inputSongInfoEntry.Text()+"': "+err.Error())
+					return
+				}
+				inputBpmEntry.SetText(floatToString(bpm))
+			}
+			inputBPM, err := parsePositiveRat(inputBpmEntry.Text())
+			if err != nil {
+				ui.MsgBoxError(window, "Error", "invalid input BPM '"+inputBpmEntry.Text()+"'")
+				return
+			}
+			bpm, _ := inputBPM.Float64()
+			candidates, _, err := suggestForFolder(folder, bpm)
+			if err != nil {
+				ui.MsgBoxError(window, "error", "couldn't suggest a ratio: "+err.Error())
+				return
+			}
+			best := candidates[0].Ratio
+			numerator.SetValue(int(best.Num().Int64()))
+			denominator.SetValue(int(best.Denom().Int64()))
+			outputBpmEntry.SetText(ratToString(inputBPM.Mul(inputBPM, best)))
+			summary := &bytes.Buffer{}
+			printSuggestions(summary, bpm, candidates)
+			ui.MsgBox(window, "suggested ratio", summary.String())
 		})
 
+		fullSongCheckbox := ui.NewCheckbox("write a complete song folder (song info, audio and cover)")
+		fullSongCheckbox.SetChecked(cliInputs.FullSong)
+		linkAssetsCheckbox := ui.NewCheckbox("hard-link audio and cover instead of copying")
+		linkAssetsCheckbox.SetChecked(cliInputs.LinkAssets)
+		snapSpinbox := ui.NewSpinbox(0, 192)
+		snapSpinbox.SetValue(cliInputs.Snap)
+		// offsetModes are the entries of offsetCombobox, in order.
+		offsetModes := []string{offsetKeep, offsetBake, offsetExtract}
+		offsetCombobox := ui.NewCombobox()
+		offsetCombobox.Append("keep the offsets")
+		offsetCombobox.Append("bake the offsets into the objects")
+		offsetCombobox.Append("extract the lead-in into the offsets")
+		offsetCombobox.SetSelected(0)
+		for i, mode := range offsetModes {
+			if mode == cliInputs.OffsetMode {
+				offsetCombobox.SetSelected(i)
+			}
+		}
+
+		anchorsEntry := ui.NewEntry()
+		anchorsEntry.SetText(formatAnchors(cliInputs.Anchors))
+		emitBPMChangesCheckbox := ui.NewCheckbox("emit BPM change markers instead of moving objects")
+		emitBPMChangesCheckbox.SetChecked(cliInputs.EmitBPMChanges)
+
 		button := ui.NewButton("Convert")
+		previewButton := ui.NewButton("Preview")
+		// cancelConversion is set while a conversion runs. Like every other
+		// piece of GUI state it is only touched on the UI thread.
+		var cancelConversion context.CancelFunc
+		cancelButton := ui.NewButton("Cancel")
+		progressBar := ui.NewProgressBar()
+		cancelButton.Disable()
+		cancelButton.OnClicked(func(*ui.Button) {
+			if cancelConversion != nil {
+				cancelConversion()
+			}
+		})
+		restoreButton := ui.NewButton("Restore a backup")
+		restoreButton.OnClicked(func(*ui.Button) {
+			showRestoreWindow(window)
+		})
 
 		box := ui.NewVerticalBox()
 		box.SetPadded(true)
-		box.Append(ui.NewLabel("All fields are required"), false)
+		box.Append(ui.NewLabel("All fields except the options are required"), false)
 
 		inputSongInfoBox := ui.NewHorizontalBox()
 		inputSongInfoBox.SetPadded(true)
 		inputSongInfoBox.Append(inputSongInfoButton, false)
 		inputSongInfoBox.Append(inputSongInfoEntry, true)
-		inputSongInfoGroup := ui.NewGroup("input song info.json")
+		inputSongInfoGroup := ui.NewGroup("input song info (Info.dat or info.json)")
 		inputSongInfoGroup.SetChild(inputSongInfoBox)
 		box.Append(inputSongInfoGroup, false)
 
@@ -160,13 +361,26 @@ func run() error {
 		multiplyBox.Append(denominator, true)
 		calcBox.Append(multiplyBox, false)
 		calcBox.Append(multiplyButton, false)
+		calcBox.Append(suggestButton, false)
+		meterBox := ui.NewHorizontalBox()
+		meterBox.SetPadded(true)
+		meterBox.Append(ui.NewLabel("song in"), false)
+		meterBox.Append(realMeterEntry, true)
+		meterBox.Append(ui.NewLabel("charted in (empty if the same)"), false)
+		meterBox.Append(editorMeterEntry, true)
+		meterBox.Append(meterButton, false)
+		calcOuterBox := ui.NewVerticalBox()
+		calcOuterBox.SetPadded(true)
+		calcOuterBox.Append(calcBox, false)
+		calcOuterBox.Append(meterBox, false)
 		calcGroup := ui.NewGroup("built-in calculator")
-		calcGroup.SetChild(calcBox)
+		calcGroup.SetChild(calcOuterBox)
 		bpmBox.Append(calcGroup, false)
 
 		outputBpmGroup := ui.NewGroup("output bpm")
 		outputBpmBox := ui.NewVerticalBox()
 		outputBpmBox.Append(loadOutputBpmButton, true)
+		outputBpmBox.Append(detectOutputBpmButton, true)
 		outputBpmBox.Append(outputBpmEntry, false)
 		outputBpmBox.Append(ui.NewLabel(""), true)
 		outputBpmGroup.SetChild(outputBpmBox)
@@ -174,25 +388,144 @@ func run() error {
 
 		box.Append(bpmBox, false)
 
+		optionsBox := ui.NewHorizontalBox()
+		optionsBox.SetPadded(true)
+		optionsBox.Append(fullSongCheckbox, false)
+		optionsBox.Append(linkAssetsCheckbox, false)
+		optionsBox.Append(ui.NewLabel("snap output times to 1/N beat (0 = off)"), false)
+		optionsBox.Append(snapSpinbox, false)
+		optionsBox.Append(offsetCombobox, false)
+		box.Append(optionsBox, false)
+
+		selectionBox := ui.NewHorizontalBox()
+		selectionBox.SetPadded(true)
+		selectionBox.Append(difficultiesBox, true)
+		selectionBox.Append(copyUnselectedCheckbox, false)
+		selectionGroup := ui.NewGroup("difficulties to convert")
+		selectionGroup.SetChild(selectionBox)
+		box.Append(selectionGroup, false)
+
+		warpBox := ui.NewHorizontalBox()
+		warpBox.SetPadded(true)
+		warpBox.Append(anchorsEntry, true)
+		warpBox.Append(emitBPMChangesCheckbox, false)
+		warpGroup := ui.NewGroup("time warp anchors (optional, e.g. 64=21.4, 128=43)")
+		warpGroup.SetChild(warpBox)
+		box.Append(warpGroup, false)
+
 		buttonsBox := ui.NewHorizontalBox()
 		buttonsBox.SetPadded(true)
 		buttonsBox.Append(button, true)
+		buttonsBox.Append(previewButton, false)
+		buttonsBox.Append(cancelButton, false)
+		buttonsBox.Append(restoreButton, false)
+		box.Append(progressBar, false)
 		box.Append(buttonsBox, true)
 
 		window.SetMargined(true)
 		window.SetChild(box)
-		button.OnClicked(func(*ui.Button) {
+		// convert runs a conversion, or a preview of one, with the inputs
+		// from the window.
+		convert := func(dryRun bool) {
 			inputs, err := validateInputs(inputSongInfoEntry.Text(), outputFolderEntry.Text(), inputBpmEntry.Text(), outputBpmEntry.Text())
 			if err != nil {
 				ui.MsgBoxError(window, "invalid input", err.Error())
 				return
 			}
-			if err := process(inputs); err != nil {
-				ui.MsgBoxError(window, "processing error", err.Error())
+			inputs.FullSong = fullSongCheckbox.Checked()
+			inputs.LinkAssets = linkAssetsCheckbox.Checked()
+			inputs.Snap = snapSpinbox.Value()
+			inputs.OffsetMode = offsetModes[offsetCombobox.Selected()]
+			// The song's meter is optional; when it's given, the output gets
+			// its beats per bar.
+			if realMeterEntry.Text() != "" {
+				if inputs.Meter, err = parseMeter(realMeterEntry.Text()); err != nil {
+					ui.MsgBoxError(window, "invalid input", err.Error())
+					return
+				}
+			}
+			if editorMeterEntry.Text() != "" {
+				if inputs.EditorMeter, err = parseMeter(editorMeterEntry.Text()); err != nil {
+					ui.MsgBoxError(window, "invalid input", err.Error())
+					return
+				}
+			}
+			if inputs.Anchors, err = parseAnchors(anchorsEntry.Text()); err != nil {
+				ui.MsgBoxError(window, "invalid input", err.Error())
+				return
+			}
+			inputs.EmitBPMChanges = emitBPMChangesCheckbox.Checked()
+			for i, checkbox := range difficultyCheckboxes {
+				if checkbox.Checked() {
+					inputs.Difficulties = append(inputs.Difficulties, difficulties[i].String())
+				}
+			}
+			if len(difficultyCheckboxes) > 0 && len(inputs.Difficulties) == 0 {
+				ui.MsgBoxError(window, "invalid input", "select at least one difficulty to convert")
 				return
 			}
-			cacheInputs(inputs)
-			ui.MsgBox(window, "success", "new beatmaps are in "+inputs.OutputFolder)
+			if len(inputs.Difficulties) == len(difficultyCheckboxes) {
+				inputs.Difficulties = nil
+			}
+			inputs.CopyUnselected = copyUnselectedCheckbox.Checked()
+			inputs.DryRun = dryRun
+			// The conversion runs in the background so the window keeps
+			// responding; everything that touches the GUI goes back through
+			// ui.QueueMain.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancelConversion = cancel
+			button.Disable()
+			previewButton.Disable()
+			cancelButton.Enable()
+			progressBar.SetValue(0)
+			go func() {
+				report, err := process(ctx, inputs, func(done, total int) {
+					ui.QueueMain(func() {
+						if total > 0 {
+							progressBar.SetValue(done * 100 / total)
+						}
+					})
+				})
+				ui.QueueMain(func() {
+					cancel()
+					cancelConversion = nil
+					button.Enable()
+					previewButton.Enable()
+					cancelButton.Disable()
+					if err == context.Canceled {
+						progressBar.SetValue(0)
+						ui.MsgBox(window, "cancelled", "the conversion was cancelled, the output folder is unchanged")
+						return
+					}
+					if err != nil {
+						progressBar.SetValue(0)
+						ui.MsgBoxError(window, "processing error", err.Error())
+						return
+					}
+					progressBar.SetValue(100)
+					if inputs.DryRun {
+						summary := &bytes.Buffer{}
+						printSummary(summary, inputs, report)
+						ui.MsgBox(window, "preview", summary.String())
+						return
+					}
+					cacheInputs(inputs)
+					cliInputs.Difficulties = inputs.Difficulties
+					message := "new beatmaps are in " + inputs.OutputFolder
+					for _, result := range report.Difficulties {
+						for _, warning := range result.Warnings {
+							message += "\nwarning: " + result.Difficulty + ": " + warning
+						}
+					}
+					ui.MsgBox(window, "success", message)
+				})
+			}()
+		}
+		button.OnClicked(func(*ui.Button) {
+			convert(false)
+		})
+		previewButton.OnClicked(func(*ui.Button) {
+			convert(true)
 		})
 		window.OnClosing(func(*ui.Window) bool {
 			ui.Quit()
@@ -242,15 +575,15 @@ func loadBpmFromFolder(songFolderPath string) (float64, error) {
 	if err != nil {
 		return 0, err
 	}
-	return info.BeatsPerMinute, nil
+	return info.BPM(), nil
 }
 
 func validateSongInfo(inputSongInfo string) error {
 	if err := ensureFile(inputSongInfo); err != nil {
 		return fmt.Errorf("input song info '%s': %s", inputSongInfo, err)
 	}
-	if filepath.Base(inputSongInfo) != "info.json" {
-		return fmt.Errorf("input song info '%s': file must be named info.json", inputSongInfo)
+	if !isSongInfoFileName(filepath.Base(inputSongInfo)) {
+		return fmt.Errorf("input song info '%s': file must be named Info.dat or info.json", inputSongInfo)
 	}
 	return nil
 }
@@ -269,24 +602,30 @@ func validateInputs(inputSongInfo, outputFolder, inputBPM, outputBPM string) (*i
 	}
 	in.InputFolder = filepath.Dir(inputSongInfo)
 
-	if err := os.MkdirAll(outputFolder, 0755); err != nil {
-		return nil, fmt.Errorf("couldn't create output folder '%s': %s", outputFolder, err)
+	// A missing output folder is created when the conversion writes to it.
+	if outputFolder == "" {
+		return nil, errors.New("output folder: required")
 	}
-	if err := validateOutputFolder(outputFolder); err != nil {
-		return nil, err
+	if _, err := os.Stat(outputFolder); err == nil {
+		if err := validateOutputFolder(outputFolder); err != nil {
+			return nil, err
+		}
 	}
 	in.OutputFolder = outputFolder
 
-	var err error
-	in.InputBPM, err = parsePositiveFloat(inputBPM)
+	// The BPMs are parsed exactly, so that their ratio is too.
+	inputRat, err := parsePositiveRat(inputBPM)
 	if err != nil {
 		return nil, fmt.Errorf("input bpm: %s", err)
 	}
+	in.InputBPM, _ = inputRat.Float64()
 
-	in.OutputBPM, err = parsePositiveFloat(outputBPM)
+	outputRat, err := parsePositiveRat(outputBPM)
 	if err != nil {
 		return nil, fmt.Errorf("output bpm: %s", err)
 	}
+	in.OutputBPM, _ = outputRat.Float64()
+	in.Ratio = new(big.Rat).Quo(outputRat, inputRat)
 	return in, nil
 }
 
@@ -300,11 +639,34 @@ func parsePositiveFloat(input string) (float64, error) {
 		return 0, err
 	}
 	if val <= 0 {
-		return 0, errors.New("input bpm: must be > 0")
+		return 0, errors.New("must be > 0")
 	}
 	return val, nil
 }
 
+// parsePositiveRat parses a number exactly. Besides decimals it accepts
+// fractions such as 200/3.
+func parsePositiveRat(input string) (*big.Rat, error) {
+	val, ok := new(big.Rat).SetString(strings.TrimSpace(input))
+	if !ok {
+		return nil, fmt.Errorf("invalid number '%s'", input)
+	}
+	if val.Sign() <= 0 {
+		return nil, errors.New("must be > 0")
+	}
+	return val, nil
+}
+
+// ratToString formats val as a decimal if that is exact, and as a fraction
+// otherwise.
+func ratToString(val *big.Rat) string {
+	f, _ := val.Float64()
+	if decimal, ok := new(big.Rat).SetString(floatToString(f)); ok && decimal.Cmp(val) == 0 {
+		return floatToString(f)
+	}
+	return val.RatString()
+}
+
 func ensureDir(path string) error {
 	fi, err := os.Stat(path)
 	if err != nil {
@@ -327,66 +689,569 @@ func ensureFile(path string) error {
 	return nil
 }
 
-func process(inputs *inputFields) error {
+// conversionReport describes what process did, or in a dry run would do.
+type conversionReport struct {
+	DryRun       bool               `json:"dryRun"`
+	Difficulties []difficultyResult `json:"difficulties"`
+	Files        []fileChange       `json:"files"`
+}
+
+// difficultyResult describes one difficulty written by process.
+type difficultyResult struct {
+	Difficulty string `json:"difficulty"`
+	OutputPath string `json:"outputPath"`
+	Notes      int    `json:"notes"`
+	Obstacles  int    `json:"obstacles"`
+	Events     int    `json:"events"`
+	// Warnings point out input that parsed but looks suspicious.
+	Warnings []string `json:"warnings,omitempty"`
+	// Copied is set for unselected difficulties that were copied unchanged.
+	Copied bool `json:"copied,omitempty"`
+	// MaxDrift is how far, in seconds, the object that moved most in the
+	// song moved.
+	MaxDrift float64 `json:"maxDriftSeconds"`
+	// MaxSnapError is how many beats the object that snapping moved most
+	// moved.
+	MaxSnapError float64 `json:"maxSnapErrorBeats,omitempty"`
+	// InputOffset and Offset are the difficulty offset in milliseconds
+	// before and after the conversion, which differ when it is baked or
+	// extracted.
+	InputOffset int `json:"inputOffset"`
+	Offset      int `json:"offset"`
+	// Preview is only set in a dry run.
+	Preview *difficultyPreview `json:"preview,omitempty"`
+}
+
+// process converts the song in inputs.InputFolder into inputs.OutputFolder.
+// Cancelling ctx stops it and leaves the output folder as it was. If
+// progress isn't nil it is called, from any goroutine, each time a
+// difficulty has been converted.
+func process(ctx context.Context, inputs *inputFields, progress func(done, total int)) (*conversionReport, error) {
 	songInfo, err := loadSongInfo(inputs.InputFolder)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := checkSongPaths(inputs, songInfo); err != nil {
+		return nil, err
+	}
+	if err := checkSelection(inputs, songInfo); err != nil {
+		return nil, err
+	}
+	if err := checkAnchors(inputs.Anchors); err != nil {
+		return nil, err
+	}
+	if inputs.OffsetMode != offsetKeep && !inputs.FullSong {
+		return nil, errors.New("changing the offsets needs a complete song folder, so that the new offsets are written")
 	}
 
-	for _, difficultyLevel := range songInfo.DifficultyLevels {
-		beatMap, err := loadBeatmap(filepath.Join(inputs.InputFolder, difficultyLevel.JSONPath))
+	// In v4 the song's tempo lives in the audio data rather than in each
+	// difficulty.
+	var audioData *AudioDataV4
+	var songChanges []tempoChange
+	if audioDataPath := songInfo.AudioDataPath(); audioDataPath != "" {
+		audioData, err = loadAudioData(filepath.Join(inputs.InputFolder, audioDataPath))
 		if err != nil {
+			return nil, err
+		}
+		songChanges = audioData.tempoChangesAt(inputs.InputBPM)
+	}
+
+	// Nothing is written to the output folder until every file has been
+	// converted, and in a dry run nothing is written at all.
+	tx := newDryRunTransaction(inputs.OutputFolder)
+	if !inputs.DryRun {
+		if tx, err = newOutputTransaction(inputs.OutputFolder); err != nil {
+			return nil, err
+		}
+	}
+	defer tx.abort()
+
+	var selected, unselected []difficulty
+	for _, difficultyLevel := range songInfo.Difficulties() {
+		if isSelected(inputs, difficultyLevel) {
+			selected = append(selected, difficultyLevel)
+		} else {
+			unselected = append(unselected, difficultyLevel)
+		}
+	}
+
+	if err := checkSharedOffsets(selected); err != nil {
+		return nil, err
+	}
+
+	// v4 lightshows are usually shared between difficulties, so each file is
+	// only converted once, by the first difficulty that uses it.
+	beatmapOwners := map[string]int{}
+	lightshowOwners := map[string]int{}
+	for i := len(selected) - 1; i >= 0; i-- {
+		beatmapOwners[selected[i].BeatmapPath] = i
+		if selected[i].LightshowPath != "" {
+			lightshowOwners[selected[i].LightshowPath] = i
+		}
+	}
+
+	var convertedLock sync.Mutex
+	converted := map[string]beatmapFile{}
+	originalTimes := map[string]beatTimes{}
+	inputTempo := map[string]tempoMap{}
+	outputOffsets := map[string]int{}
+	snapErrors := map[string]float64{}
+	markers := outputTempoChanges(inputs)
+	convertFile := func(ctx context.Context, relativePath string, beatMap beatmapFile, c beatConverter, input tempoMap, outputOffset int) error {
+		before := beatMap.Times()
+		var snapper *snapConverter
+		if inputs.Snap > 0 {
+			snapper = newSnapConverter(c, inputs.Snap)
+			c = snapper
+		}
+		beatMap.Rescale(c)
+		if markers != nil {
+			beatMap.SetTempoChanges(markers)
+		}
+		beatMap.SetBPM(inputs.OutputBPM)
+		if inputs.Meter.Count > 0 {
+			beatMap.SetBeatsPerBar(inputs.Meter.beatsPerBar())
+		}
+		if err := ctx.Err(); err != nil {
 			return err
 		}
-		for i, note := range beatMap.Notes {
-			beatMap.Notes[i].Time = convertTimeWithOffset(note.Time, inputs.InputBPM, inputs.OutputBPM, difficultyLevel.Offset)
+		if inputs.DryRun {
+			tx.record(relativePath)
+		} else if err := saveBeatmap(tx, relativePath, beatMap); err != nil {
+			return err
 		}
-		for i, obstacle := range beatMap.Obstacles {
-			beatMap.Obstacles[i].Time = convertTimeWithOffset(obstacle.Time, inputs.InputBPM, inputs.OutputBPM, difficultyLevel.Offset)
-			beatMap.Obstacles[i].Duration = convertTime(obstacle.Duration, inputs.InputBPM, inputs.OutputBPM)
+		convertedLock.Lock()
+		converted[relativePath] = beatMap
+		originalTimes[relativePath] = before
+		inputTempo[relativePath] = input
+		outputOffsets[relativePath] = outputOffset
+		if snapper != nil {
+			snapErrors[relativePath] = snapper.maxError
 		}
-		beatMap.BeatsPerMinute = inputs.OutputBPM
-		if err := saveBeatmap(filepath.Join(inputs.OutputFolder, difficultyLevel.JSONPath), beatMap); err != nil {
+		convertedLock.Unlock()
+		return nil
+	}
+
+	var doneLock sync.Mutex
+	done := 0
+	reportProgress := func() {
+		if progress == nil {
+			return
+		}
+		doneLock.Lock()
+		done++
+		progress(done, len(selected))
+		doneLock.Unlock()
+	}
+	if progress != nil {
+		progress(0, len(selected))
+	}
+
+	// offsets are the difficulty offsets to write, which only change when
+	// they are baked or extracted.
+	offsets := make([]int, len(selected))
+	for i, difficultyLevel := range selected {
+		offsets[i] = difficultyLevel.Offset
+	}
+
+	// The difficulties are converted in parallel. Each one only converts the
+	// files it owns, so they share nothing but converted and tx.
+	err = forEach(ctx, len(selected), func(ctx context.Context, i int) error {
+		defer reportProgress()
+		difficultyLevel := selected[i]
+		ownsBeatmap := beatmapOwners[difficultyLevel.BeatmapPath] == i
+		ownsLightshow := difficultyLevel.LightshowPath != "" && lightshowOwners[difficultyLevel.LightshowPath] == i
+		if !ownsBeatmap && !ownsLightshow {
+			return nil
+		}
+		// The beatmap is needed for its tempo changes even if another
+		// difficulty converts it.
+		beatMap, err := loadBeatmap(filepath.Join(inputs.InputFolder, difficultyLevel.BeatmapPath))
+		if err != nil {
 			return err
 		}
+		changes := append(beatMap.TempoChanges(), songChanges...)
+		c := newConverter(inputs, difficultyLevel.Offset, changes)
+		input := newTempoMap(inputs.InputBPM, changes, difficultyLevel.Offset)
+		if inputs.OffsetMode != offsetKeep {
+			var shift float64
+			first := c.Beat(firstBeat(beatMap.Times(), changes))
+			shift, offsets[i] = offsetShift(inputs.OffsetMode, difficultyLevel.Offset, inputs.OutputBPM, first)
+			if shift != 0 {
+				c = shiftConverter{c, shift}
+			}
+		}
+		if ownsBeatmap {
+			if err := convertFile(ctx, difficultyLevel.BeatmapPath, beatMap, c, input, offsets[i]); err != nil {
+				return err
+			}
+		}
+		if ownsLightshow {
+			lightshow, err := loadLightshow(filepath.Join(inputs.InputFolder, difficultyLevel.LightshowPath))
+			if err != nil {
+				return err
+			}
+			if err := convertFile(ctx, difficultyLevel.LightshowPath, lightshow, c, input, offsets[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+
+	var results []difficultyResult
+	for i, difficultyLevel := range selected {
+		// A difficulty that shares its beatmap gets the offset that went
+		// with the conversion of it, which checkSharedOffsets made sure was
+		// its own to begin with.
+		offsets[i] = outputOffsets[difficultyLevel.BeatmapPath]
+		beatMap := converted[difficultyLevel.BeatmapPath]
+		result := difficultyResult{
+			Difficulty:  difficultyLevel.String(),
+			OutputPath:  filepath.Join(inputs.OutputFolder, difficultyLevel.BeatmapPath),
+			InputOffset: difficultyLevel.Offset,
+			Offset:      offsets[i],
+		}
+		result.Notes, result.Obstacles, result.Events = beatMap.Counts()
+		result.Warnings = checkBeatmap(beatMap)
+		before, after := originalTimes[difficultyLevel.BeatmapPath], beatMap.Times()
+		if difficultyLevel.LightshowPath != "" {
+			lightshow := converted[difficultyLevel.LightshowPath]
+			_, _, events := lightshow.Counts()
+			result.Events += events
+			before = before.add(originalTimes[difficultyLevel.LightshowPath])
+			after = after.add(lightshow.Times())
+		}
+		if result.Offset != result.InputOffset && firstBeat(after, nil) < 0 {
+			result.Warnings = append(result.Warnings, "objects moved before the start of the song")
+		}
+		result.MaxSnapError = math.Max(snapErrors[difficultyLevel.BeatmapPath], snapErrors[difficultyLevel.LightshowPath])
+		if inputs.DryRun {
+			result.Preview = newDifficultyPreview(before, after)
+		}
+		results = append(results, result)
+	}
+
+	// Unselected difficulties are copied after the selected ones are
+	// converted, so that it is known which of their files were converted.
+	if inputs.CopyUnselected {
+		// The song's BPM is shared by every difficulty, so a copy keeps the
+		// input timing against the output BPM once the song info or the
+		// audio data is written.
+		var warnings []string
+		if (inputs.FullSong || audioData != nil) && inputs.ratio().Cmp(big.NewRat(1, 1)) != 0 {
+			warnings = append(warnings, fmt.Sprintf("copied unchanged but the song is now %s BPM, so it plays at the wrong speed", floatToString(inputs.OutputBPM)))
+		} else if audioData != nil && (markers != nil || len(inputs.Anchors) > 0) {
+			warnings = append(warnings, fmt.Sprintf("copied unchanged but %s was rewritten, so it may play out of time", songInfo.AudioDataPath()))
+		}
+		// A converted lightshow that an unselected difficulty also uses is
+		// copied unchanged under a name of its own, once for all of them.
+		// That needs the song info written; otherwise the difficulty is left
+		// with the converted one.
+		clones := map[string]string{}
+		for _, difficultyLevel := range unselected {
+			result := difficultyResult{
+				Difficulty: difficultyLevel.String(),
+				OutputPath: filepath.Join(inputs.OutputFolder, difficultyLevel.BeatmapPath),
+				Copied:     true,
+				Warnings:   append([]string(nil), warnings...),
+			}
+			if converted[difficultyLevel.BeatmapPath] != nil {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("shares %s with a converted difficulty, so it was converted too", difficultyLevel.BeatmapPath))
+			}
+			if relativePath := difficultyLevel.LightshowPath; converted[relativePath] != nil {
+				if !inputs.FullSong {
+					result.Warnings = append(result.Warnings, fmt.Sprintf("shares %s with a converted difficulty, so it was converted too", relativePath))
+				} else {
+					clone, ok := clones[relativePath]
+					if !ok {
+						clone = unusedName(inputs, songInfo, clones, relativePath)
+						if err := tx.CopyFile(filepath.Join(inputs.InputFolder, relativePath), clone, false); err != nil {
+							return nil, fmt.Errorf("difficulty %s: %s", difficultyLevel, err)
+						}
+						clones[relativePath] = clone
+					}
+					if err := songInfo.SetLightshowPath(difficultyLevel, clone); err != nil {
+						return nil, err
+					}
+				}
+			}
+			for _, relativePath := range []string{difficultyLevel.BeatmapPath, difficultyLevel.LightshowPath} {
+				src := filepath.Join(inputs.InputFolder, relativePath)
+				if relativePath == "" || converted[relativePath] != nil || sameFile(src, filepath.Join(inputs.OutputFolder, relativePath)) {
+					continue
+				}
+				if err := tx.CopyFile(src, relativePath, false); err != nil {
+					return nil, fmt.Errorf("difficulty %s: %s", difficultyLevel, err)
+				}
+			}
+			results = append(results, result)
+		}
+	}
+
+	if audioData != nil {
+		switch {
+		case markers != nil:
+			audioData.SetTempoMap(newTempoMap(inputs.OutputBPM, markers, 0))
+		case len(inputs.Anchors) > 0 || len(audioData.BPMData) == 0:
+			audioData.SetTempoMap(newTempoMap(inputs.OutputBPM, nil, 0))
+		default:
+			audioData.Rescale(newConverter(inputs, 0, songChanges))
+		}
+		if inputs.DryRun {
+			tx.record(songInfo.AudioDataPath())
+		} else if err := saveBeatmap(tx, songInfo.AudioDataPath(), audioData); err != nil {
+			return nil, err
+		}
+	}
+
+	// Every object should still fall on the same moment of the song, which
+	// is checked against the files as they were written. Time warps move
+	// objects on purpose, so there is nothing to check them against.
+	if len(inputs.Anchors) == 0 {
+		reload := func(relativePath string) (beatmapFile, error) {
+			if inputs.DryRun {
+				return converted[relativePath], nil
+			}
+			if _, ok := lightshowOwners[relativePath]; ok {
+				return loadLightshow(tx.stagedPath(relativePath))
+			}
+			return loadBeatmap(tx.stagedPath(relativePath))
+		}
+		var outputSongChanges []tempoChange
+		if audioData != nil {
+			written := audioData
+			if !inputs.DryRun {
+				if written, err = loadAudioData(tx.stagedPath(songInfo.AudioDataPath())); err != nil {
+					return nil, err
+				}
+			}
+			outputSongChanges = written.tempoChangesAt(inputs.OutputBPM)
+		}
+		drifts := map[string]float64{}
+		for relativePath, input := range inputTempo {
+			written, err := reload(relativePath)
+			if err != nil {
+				return nil, err
+			}
+			// A lightshow keeps time by the tempo changes of its difficulty's
+			// beatmap.
+			timing := written
+			if _, ok := lightshowOwners[relativePath]; ok {
+				timing = converted[selected[lightshowOwners[relativePath]].BeatmapPath]
+			}
+			output := newTempoMap(inputs.OutputBPM, append(timing.TempoChanges(), outputSongChanges...), outputOffsets[relativePath])
+			// Snapping moves objects on purpose, but only as far as it said.
+			tolerance := verifyTolerance + snapErrors[relativePath]*output.longestBeat()
+			if drifts[relativePath], err = verifyFile(relativePath, originalTimes[relativePath], input, written.Times(), output, tolerance); err != nil {
+				return nil, err
+			}
+		}
+		for i, difficultyLevel := range selected {
+			results[i].MaxDrift = math.Max(drifts[difficultyLevel.BeatmapPath], drifts[difficultyLevel.LightshowPath])
+		}
+	}
+
+	if inputs.FullSong {
+		for i, difficultyLevel := range selected {
+			if offsets[i] == difficultyLevel.Offset {
+				continue
+			}
+			if err := songInfo.SetOffset(difficultyLevel, offsets[i]); err != nil {
+				return nil, err
+			}
+		}
+		if err := writeSongFolder(inputs, songInfo, tx); err != nil {
+			return nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	report := &conversionReport{DryRun: inputs.DryRun, Difficulties: results, Files: tx.changes()}
+	if inputs.DryRun {
+		return report, nil
+	}
+	if err := backupOutput(tx); err != nil {
+		return nil, err
+	}
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// beatConverter maps positions in the input beatmap onto the output beatmap.
+type beatConverter interface {
+	// Beat converts a beat position.
+	Beat(beat float64) float64
+	// Duration converts a length in beats that starts at beat.
+	Duration(beat, duration float64) float64
+	// Tempo converts a BPM value in effect at beat.
+	Tempo(beat, bpm float64) float64
+}
+
+// linearConverter is the constant ratio conversion between two BPMs. ratio
+// is the output BPM over the input BPM.
+type linearConverter struct {
+	inputBPM float64
+	ratio    *big.Rat
+	offset   int
+}
+
+func (c linearConverter) Beat(beat float64) float64 {
+	return convertTimeWithOffset(beat, c.inputBPM, c.ratio, c.offset)
 }
 
-func convertTimeWithOffset(oldTime, inputBPM, outputBPM float64, offset int) float64 {
-	inputOffset := inputBPM * float64(offset) / 60000
-	outputOffset := outputBPM * float64(offset) / 60000
-	return convertTime(oldTime-inputOffset, inputBPM, outputBPM) + outputOffset
+func (c linearConverter) Duration(beat, duration float64) float64 {
+	return convertTime(duration, c.ratio)
 }
 
-func convertTime(oldTime, inputBPM, outputBPM float64) float64 {
-	return oldTime * outputBPM / inputBPM
+func (c linearConverter) Tempo(beat, bpm float64) float64 {
+	return convertTime(bpm, c.ratio)
 }
 
-func loadSongInfo(folderPath string) (*SongInfo, error) {
-	filePath := filepath.Join(folderPath, "info.json")
+// convertTimeWithOffset and convertTime calculate exactly and round once at
+// the end, so a beat that lands on the grid at the new BPM comes out on it.
+func convertTimeWithOffset(oldTime, inputBPM float64, ratio *big.Rat, offset int) float64 {
+	inputOffset := new(big.Rat).SetFloat64(inputBPM)
+	inputOffset.Mul(inputOffset, big.NewRat(int64(offset), 60000))
+	outputOffset := new(big.Rat).Mul(inputOffset, ratio)
+	newTime := new(big.Rat).SetFloat64(oldTime)
+	newTime.Sub(newTime, inputOffset)
+	newTime.Mul(newTime, ratio)
+	newTime.Add(newTime, outputOffset)
+	f, _ := newTime.Float64()
+	return f
+}
+
+func convertTime(oldTime float64, ratio *big.Rat) float64 {
+	newTime := new(big.Rat).SetFloat64(oldTime)
+	f, _ := newTime.Mul(newTime, ratio).Float64()
+	return f
+}
+
+// songInfoFileNames lists the song info file names bpm-saber looks for, in
+// order of preference.
+var songInfoFileNames = []string{"Info.dat", "info.dat", "info.json"}
+
+func isSongInfoFileName(name string) bool {
+	return strings.EqualFold(name, "info.dat") || name == "info.json"
+}
+
+// findSongInfo returns the path of the song info file in folderPath.
+func findSongInfo(folderPath string) (string, error) {
+	for _, name := range songInfoFileNames {
+		filePath := filepath.Join(folderPath, name)
+		if ensureFile(filePath) == nil {
+			return filePath, nil
+		}
+	}
+	return "", fmt.Errorf("no Info.dat or info.json in '%s'", folderPath)
+}
+
+func loadSongInfo(folderPath string) (songInfoFile, error) {
+	filePath, err := findSongInfo(folderPath)
+	if err != nil {
+		return nil, err
+	}
 	raw, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
-	songInfo := &SongInfo{}
-	json.Unmarshal(raw, songInfo)
+
+	// The layouts are told apart by their difficulty list rather than
+	// the file name, since both names have been used with either layout by
+	// one tool or another.
+	var keys map[string]json.RawMessage
+	if err := decodeFile(filePath, raw, &keys); err != nil {
+		return nil, err
+	}
+	var songInfo songInfoFile
+	switch {
+	case keys["difficultyBeatmaps"] != nil:
+		songInfo = &SongInfoV4{}
+	case keys["_difficultyBeatmapSets"] != nil:
+		songInfo = &SongInfoV2{}
+	case keys["difficultyLevels"] != nil:
+		songInfo = &SongInfo{}
+	default:
+		return nil, fmt.Errorf("song info '%s': unrecognized format", filePath)
+	}
+	if err := decodeFile(filePath, raw, songInfo); err != nil {
+		return nil, err
+	}
 	return songInfo, nil
 }
 
-func loadBeatmap(filePath string) (*BeatMap, error) {
+func saveSongInfo(tx *outputTransaction, songInfo songInfoFile) error {
+	buffer, err := marshalNoEscape(songInfo)
+	if err != nil {
+		return err
+	}
+	return tx.WriteFile(songInfo.FileName(), buffer)
+}
+
+func loadBeatmap(filePath string) (beatmapFile, error) {
 	raw, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
-	beatMap := &BeatMap{}
-	json.Unmarshal(raw, beatMap)
+
+	// v3 files replaced "_version" with "version" along with every other key.
+	var keys map[string]json.RawMessage
+	if err := decodeFile(filePath, raw, &keys); err != nil {
+		return nil, err
+	}
+	var beatMap beatmapFile = &BeatMap{}
+	if keys["version"] != nil {
+		beatMap = &BeatMapV3{}
+		var version string
+		if err := json.Unmarshal(keys["version"], &version); err != nil {
+			return nil, fmt.Errorf("%s: version: %s", filePath, err)
+		}
+		if strings.HasPrefix(version, "4.") {
+			beatMap = &BeatMapV4{}
+		}
+	}
+	if err := decodeFile(filePath, raw, beatMap); err != nil {
+		return nil, err
+	}
 	return beatMap, nil
 }
 
-func saveBeatmap(filePath string, beatMap *BeatMap) error {
-	buffer, _ := json.Marshal(beatMap)
-	return ioutil.WriteFile(filePath, buffer, 0644)
+func loadLightshow(filePath string) (beatmapFile, error) {
+	raw, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	lightshow := &LightshowV4{}
+	if err := decodeFile(filePath, raw, lightshow); err != nil {
+		return nil, err
+	}
+	return lightshow, nil
+}
+
+func loadAudioData(filePath string) (*AudioDataV4, error) {
+	raw, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	audioData := &AudioDataV4{}
+	if err := decodeFile(filePath, raw, audioData); err != nil {
+		return nil, err
+	}
+	return audioData, nil
+}
+
+func saveBeatmap(tx *outputTransaction, relativePath string, beatMap interface{}) error {
+	buffer, err := marshalNoEscape(beatMap)
+	if err != nil {
+		return err
+	}
+	return tx.WriteFile(relativePath, buffer)
 }
 
 func getInput() *inputFields {
@@ -396,7 +1261,39 @@ func getInput() *inputFields {
 	flag.StringVar(&in.OutputFolder, "outputFolder", cached.OutputFolder, "folder to save new BPM")
 	flag.Float64Var(&in.InputBPM, "inputBPM", cached.InputBPM, "intended initial BPM")
 	flag.Float64Var(&in.OutputBPM, "outputBPM", cached.OutputBPM, "intended new BPM")
+	flag.BoolVar(&in.FullSong, "fullSong", cached.FullSong, "also write the song info and copy the audio and cover")
+	flag.BoolVar(&in.LinkAssets, "link", cached.LinkAssets, "hard-link the audio and cover instead of copying them")
+	flag.IntVar(&in.Snap, "snap", cached.Snap, "round converted beats to the nearest 1/N beat, 0 to keep them exact")
+	meterText := flag.String("meter", "", "the song's real time signature, such as 6/8")
+	editorMeterText := flag.String("editorMeter", "", "the time signature the editor assumed, whose 1/N note is the editor's beat; the song's by default")
+	offsetText := flag.String("offset", "", "keep the difficulty offsets, bake them into the object times or extract a lead-in into them")
+	var anchors anchorList
+	flag.Var(&anchors, "anchor", "warp anchor EDITOR_BEAT=REAL_BEAT (repeatable)")
+	flag.BoolVar(&in.EmitBPMChanges, "emitBPMChanges", cached.EmitBPMChanges, "follow the warp anchors with BPM change markers instead of moving objects")
+	var difficulties stringList
+	flag.Var(&difficulties, "difficulty", "only convert difficulties matching CHARACTERISTIC/NAME, NAME or CHARACTERISTIC/* (repeatable)")
+	flag.BoolVar(&in.CopyUnselected, "copyUnselected", cached.CopyUnselected, "copy the difficulties that aren't converted unchanged instead of leaving them out")
 	flag.Parse()
+	in.Ratio = cached.Ratio
+	in.Meter, in.EditorMeter = cached.Meter, cached.EditorMeter
+	if m, err := parseMeter(*meterText); err == nil {
+		in.Meter = m
+	}
+	if m, err := parseMeter(*editorMeterText); err == nil {
+		in.EditorMeter = m
+	}
+	in.OffsetMode = cached.OffsetMode
+	if mode, err := parseOffsetMode(*offsetText); err == nil {
+		in.OffsetMode = mode
+	}
+	in.Anchors = cached.Anchors
+	if len(anchors) > 0 {
+		in.Anchors = anchors
+	}
+	in.Difficulties = cached.Difficulties
+	if len(difficulties) > 0 {
+		in.Difficulties = difficulties
+	}
 	return &in
 }
 
@@ -405,8 +1302,79 @@ type inputFields struct {
 	OutputFolder string
 	InputBPM     float64
 	OutputBPM    float64
+	// Ratio is OutputBPM/InputBPM, exactly as entered. Use ratio() to read
+	// it, since it isn't always set.
+	Ratio      *big.Rat
+	FullSong   bool
+	LinkAssets bool
+	// Snap, if set, rounds every converted beat to the nearest 1/Snap beat.
+	Snap int
+	// Meter, if set, is the song's real time signature, whose beats per bar
+	// are written to the output. EditorMeter is the one the editor assumed,
+	// which is only remembered for the calculator.
+	Meter       meter
+	EditorMeter meter
+	// OffsetMode says whether the difficulty offsets are kept, baked into
+	// the object times or extracted from them (see offsetShift).
+	OffsetMode string
+	// Anchors, if set, warp the beatmap instead of applying the BPM ratio.
+	Anchors        []anchor
+	EmitBPMChanges bool
+	// Difficulties, if set, limits the conversion to the difficulties that
+	// match these filters (see filterMatches). The others are copied
+	// unchanged if CopyUnselected is set and left out otherwise.
+	Difficulties   []string
+	CopyUnselected bool
+	// DryRun reports what the conversion would do without writing
+	// anything. It is never cached.
+	DryRun bool `json:"-"`
 }
 
+// ratio returns the output BPM over the input BPM.
+func (in *inputFields) ratio() *big.Rat {
+	if in.Ratio != nil {
+		return in.Ratio
+	}
+	return new(big.Rat).Quo(new(big.Rat).SetFloat64(in.OutputBPM), new(big.Rat).SetFloat64(in.InputBPM))
+}
+
+// songInfoFile is implemented by each supported song info layout.
+type songInfoFile interface {
+	FileName() string
+	BPM() float64
+	SetBPM(bpm float64)
+	Difficulties() []difficulty
+	// SetOffset sets the offset of difficulty d, in milliseconds.
+	SetOffset(d difficulty, offset int) error
+	// SetLightshowPath points difficulty d at another lightshow file.
+	SetLightshowPath(d difficulty, relativePath string) error
+	// AudioDataPath returns the v4 AudioData.dat file name, if any.
+	AudioDataPath() string
+	// Assets returns the audio and image files the song info refers to.
+	Assets() []string
+}
+
+// difficulty is the format independent part of a song info difficulty entry
+// that process needs.
+type difficulty struct {
+	Characteristic string
+	Name           string
+	BeatmapPath    string
+	LightshowPath  string
+	// AudioPath is the song's audio file, which only the original layout
+	// sets per difficulty.
+	AudioPath string
+	Offset    int
+}
+
+func (d difficulty) String() string {
+	if d.Characteristic == "" {
+		return d.Name
+	}
+	return d.Characteristic + "/" + d.Name
+}
+
+// SongInfo is the original info.json layout.
 type SongInfo struct {
 	SongName         string            `json:"songName"`
 	SongSubName      string            `json:"songSubName"`
@@ -417,6 +1385,8 @@ type SongInfo struct {
 	CoverImagePath   string            `json:"coverImagePath"`
 	EnvironmentName  string            `json:"environmentName"`
 	DifficultyLevels []DifficultyLevel `json:"difficultyLevels"`
+
+	raw rawObject
 }
 
 type DifficultyLevel struct {
@@ -426,18 +1396,210 @@ type DifficultyLevel struct {
 	JSONPath       string `json:"jsonPath"`
 	Offset         int    `json:"offset"`
 	OldOffset      int    `json:"oldOffset"`
+
+	raw rawObject
+}
+
+func (s *SongInfo) FileName() string      { return "info.json" }
+func (s *SongInfo) BPM() float64          { return s.BeatsPerMinute }
+func (s *SongInfo) SetBPM(bpm float64)    { s.BeatsPerMinute = bpm }
+func (s *SongInfo) AudioDataPath() string { return "" }
+
+func (s *SongInfo) Assets() []string {
+	assets := []string{s.CoverImagePath}
+	for _, level := range s.DifficultyLevels {
+		assets = append(assets, level.AudioPath)
+	}
+	return assets
+}
+
+func (s *SongInfo) Difficulties() []difficulty {
+	var difficulties []difficulty
+	for _, level := range s.DifficultyLevels {
+		difficulties = append(difficulties, difficulty{
+			Name:        level.Difficulty,
+			BeatmapPath: level.JSONPath,
+			AudioPath:   level.AudioPath,
+			Offset:      level.Offset,
+		})
+	}
+	return difficulties
+}
+
+// SetOffset also sets the difficulty's oldOffset, which older versions of the
+// game read instead, so that they agree.
+func (s *SongInfo) SetOffset(d difficulty, offset int) error {
+	for i, level := range s.DifficultyLevels {
+		if level.Difficulty == d.Name && level.JSONPath == d.BeatmapPath {
+			s.DifficultyLevels[i].Offset = offset
+			s.DifficultyLevels[i].OldOffset = offset
+		}
+	}
+	return nil
 }
 
+// SetLightshowPath fails, since the original layout has no lightshow files.
+func (s *SongInfo) SetLightshowPath(d difficulty, relativePath string) error {
+	return fmt.Errorf("difficulty %s: info.json has no lightshow files", d)
+}
+
+// beatmapFile is implemented by each supported difficulty file layout.
+type beatmapFile interface {
+	Rescale(c beatConverter)
+	SetBPM(bpm float64)
+	// SetBeatsPerBar sets how many beats apart editors draw bar lines.
+	SetBeatsPerBar(beats int)
+	Counts() (notes, obstacles, events int)
+	// Times returns the beats of the objects Counts counts.
+	Times() beatTimes
+	// TempoChanges returns the BPM change markers in the file, if any.
+	TempoChanges() []tempoChange
+	// SetTempoChanges replaces the BPM change markers in the file.
+	SetTempoChanges(changes []tempoChange)
+}
+
+// BeatMap is the difficulty layout shared by info.json songs and v2 Info.dat
+// songs.
 type BeatMap struct {
-	Version        string        `json:"_version"`
-	BeatsPerMinute float64       `json:"_beatsPerMinute"`
-	BeatsPerBar    int           `json:"_beatsPerBar"`
-	NoteJumpSpeed  int           `json:"_noteJumpSpeed"`
-	Shuffle        int           `json:"_shuffle"`
-	ShufflePeriod  float64       `json:"_shufflePeriod"`
-	Events         []interface{} `json:"_events"`
-	Notes          []Note        `json:"_notes"`
-	Obstacles      []Obstacle    `json:"_obstacles"`
+	Version        string             `json:"_version"`
+	BeatsPerMinute float64            `json:"_beatsPerMinute"`
+	BeatsPerBar    int                `json:"_beatsPerBar"`
+	NoteJumpSpeed  int                `json:"_noteJumpSpeed"`
+	Shuffle        int                `json:"_shuffle"`
+	ShufflePeriod  float64            `json:"_shufflePeriod"`
+	Events         []Event            `json:"_events"`
+	Notes          []Note             `json:"_notes"`
+	Obstacles      []Obstacle         `json:"_obstacles"`
+	Waypoints      []TimeObject       `json:"_waypoints"`
+	Sliders        []Slider           `json:"_sliders"`
+	BPMChanges     []BPMChange        `json:"_BPMChanges"`
+	CustomData     *BeatMapCustomData `json:"_customData"`
+
+	raw rawObject
+}
+
+func (b *BeatMap) Rescale(c beatConverter) {
+	for i, event := range b.Events {
+		if event.Type == bpmChangeEventType && event.FloatValue != nil {
+			bpm := c.Tempo(event.Time, *event.FloatValue)
+			b.Events[i].FloatValue = &bpm
+		}
+		b.Events[i].Time = c.Beat(event.Time)
+	}
+	for i, note := range b.Notes {
+		b.Notes[i].Time = c.Beat(note.Time)
+	}
+	for i, obstacle := range b.Obstacles {
+		b.Obstacles[i].Time = c.Beat(obstacle.Time)
+		b.Obstacles[i].Duration = c.Duration(obstacle.Time, obstacle.Duration)
+	}
+	for i, waypoint := range b.Waypoints {
+		b.Waypoints[i].Time = c.Beat(waypoint.Time)
+	}
+	for i, slider := range b.Sliders {
+		b.Sliders[i].HeadTime = c.Beat(slider.HeadTime)
+		b.Sliders[i].TailTime = c.Beat(slider.TailTime)
+	}
+	rescaleBPMChanges(b.BPMChanges, c)
+	if b.CustomData != nil {
+		rescaleBPMChanges(b.CustomData.BPMChanges, c)
+		for i, bookmark := range b.CustomData.Bookmarks {
+			b.CustomData.Bookmarks[i].Time = c.Beat(bookmark.Time)
+		}
+	}
+}
+
+func rescaleBPMChanges(changes []BPMChange, c beatConverter) {
+	for i, change := range changes {
+		changes[i].BPM = c.Tempo(change.Time, change.BPM)
+		changes[i].Time = c.Beat(change.Time)
+	}
+}
+
+// TempoChanges collects the BPM changes from wherever the editor that made
+// the map put them: MediocreMapper and ChroMapper write _BPMChanges (at the
+// top level in old versions, under _customData in newer ones), and the game
+// itself uses _events of type 100 with the BPM in _floatValue.
+func (b *BeatMap) TempoChanges() []tempoChange {
+	var changes []tempoChange
+	for _, event := range b.Events {
+		if event.Type == bpmChangeEventType && event.FloatValue != nil {
+			changes = append(changes, tempoChange{Beat: event.Time, BPM: *event.FloatValue})
+		}
+	}
+	// Copied, so that appending can't write into spare capacity of
+	// b.BPMChanges.
+	bpmChanges := append([]BPMChange(nil), b.BPMChanges...)
+	if b.CustomData != nil {
+		bpmChanges = append(bpmChanges, b.CustomData.BPMChanges...)
+	}
+	for _, change := range bpmChanges {
+		changes = append(changes, tempoChange{Beat: change.Time, BPM: change.BPM})
+	}
+	return changes
+}
+
+func (b *BeatMap) SetBPM(bpm float64) { b.BeatsPerMinute = bpm }
+
+// SetBeatsPerBar only changes files that have a _beatsPerBar, which v2 .dat
+// files don't.
+func (b *BeatMap) SetBeatsPerBar(beats int) { b.BeatsPerBar = beats }
+
+func (b *BeatMap) Counts() (notes, obstacles, events int) {
+	return len(b.Notes), len(b.Obstacles), len(b.Events)
+}
+
+func (b *BeatMap) Times() beatTimes {
+	var times beatTimes
+	for _, note := range b.Notes {
+		times.Notes = append(times.Notes, note.Time)
+	}
+	for _, obstacle := range b.Obstacles {
+		times.Obstacles = append(times.Obstacles, obstacle.Time)
+	}
+	for _, event := range b.Events {
+		times.Events = append(times.Events, event.Time)
+	}
+	return times
+}
+
+// SetTempoChanges writes the markers both as BPM change events, which the
+// game plays by, and as _customData._BPMChanges, which the editors draw the
+// grid from.
+func (b *BeatMap) SetTempoChanges(changes []tempoChange) {
+	events := make([]Event, 0, len(b.Events)+len(changes))
+	for _, event := range b.Events {
+		if event.Type != bpmChangeEventType {
+			events = append(events, event)
+		}
+	}
+	b.BPMChanges = nil
+	if b.CustomData == nil {
+		b.CustomData = &BeatMapCustomData{}
+	}
+	b.CustomData.BPMChanges = nil
+	for _, change := range changes {
+		bpm := change.BPM
+		events = append(events, Event{Time: change.Beat, Type: bpmChangeEventType, FloatValue: &bpm})
+		b.CustomData.BPMChanges = append(b.CustomData.BPMChanges, BPMChange{Time: change.Beat, BPM: change.BPM})
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time < events[j].Time })
+	b.Events = events
+	b.raw.include("_events")
+	b.raw.include("_customData")
+	b.CustomData.raw.include("_BPMChanges")
+}
+
+// bpmChangeEventType is the _events _type the game uses for BPM changes.
+const bpmChangeEventType = 100
+
+type Event struct {
+	Time       float64  `json:"_time"`
+	Type       int      `json:"_type"`
+	Value      int      `json:"_value"`
+	FloatValue *float64 `json:"_floatValue,omitempty"`
+
+	raw rawObject
 }
 
 type Note struct {
@@ -446,6 +1608,8 @@ type Note struct {
 	LineLayer    int     `json:"_lineLayer"`
 	Type         int     `json:"_type"`
 	CutDirection int     `json:"_cutDirection"`
+
+	raw rawObject
 }
 
 type Obstacle struct {
@@ -454,4 +1618,144 @@ type Obstacle struct {
 	Type      int     `json:"_type"`
 	Duration  float64 `json:"_duration"`
 	Width     int     `json:"_width"`
+
+	raw rawObject
+}
+
+// TimeObject is any v2 object whose only time field is its _time, such as
+// waypoints and bookmarks.
+type TimeObject struct {
+	Time float64 `json:"_time"`
+
+	raw rawObject
+}
+
+// Slider only appears in v2 .dat beatmaps. As with TimeObject, only its time
+// fields are modeled; everything else is carried along in raw.
+type Slider struct {
+	HeadTime float64 `json:"_headTime"`
+	TailTime float64 `json:"_tailTime"`
+
+	raw rawObject
+}
+
+// BPMChange is an editor BPM change marker.
+type BPMChange struct {
+	Time float64 `json:"_time"`
+	BPM  float64 `json:"_BPM"`
+
+	raw rawObject
+}
+
+// BeatMapCustomData is the part of _customData that holds beat positions.
+type BeatMapCustomData struct {
+	BPMChanges []BPMChange  `json:"_BPMChanges,omitempty"`
+	Bookmarks  []TimeObject `json:"_bookmarks,omitempty"`
+
+	raw rawObject
+}
+
+// The methods below route every model type through unmarshalObject and
+// marshalObject so that fields not listed in the structs are preserved.
+// Each one converts to a local alias type first so the json package doesn't
+// call back into the same method.
+
+func (s *SongInfo) UnmarshalJSON(data []byte) error {
+	type songInfo SongInfo
+	return unmarshalObject(data, (*songInfo)(s), &s.raw)
+}
+
+func (s SongInfo) MarshalJSON() ([]byte, error) {
+	type songInfo SongInfo
+	return marshalObject(songInfo(s), s.raw)
+}
+
+func (d *DifficultyLevel) UnmarshalJSON(data []byte) error {
+	type difficultyLevel DifficultyLevel
+	return unmarshalObject(data, (*difficultyLevel)(d), &d.raw)
+}
+
+func (d DifficultyLevel) MarshalJSON() ([]byte, error) {
+	type difficultyLevel DifficultyLevel
+	return marshalObject(difficultyLevel(d), d.raw)
+}
+
+func (b *BeatMap) UnmarshalJSON(data []byte) error {
+	type beatMap BeatMap
+	return unmarshalObject(data, (*beatMap)(b), &b.raw)
+}
+
+func (b BeatMap) MarshalJSON() ([]byte, error) {
+	type beatMap BeatMap
+	return marshalObject(beatMap(b), b.raw)
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	type event Event
+	return unmarshalObject(data, (*event)(e), &e.raw)
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	type event Event
+	return marshalObject(event(e), e.raw)
+}
+
+func (n *Note) UnmarshalJSON(data []byte) error {
+	type note Note
+	return unmarshalObject(data, (*note)(n), &n.raw)
+}
+
+func (n Note) MarshalJSON() ([]byte, error) {
+	type note Note
+	return marshalObject(note(n), n.raw)
+}
+
+func (o *Obstacle) UnmarshalJSON(data []byte) error {
+	type obstacle Obstacle
+	return unmarshalObject(data, (*obstacle)(o), &o.raw)
+}
+
+func (o Obstacle) MarshalJSON() ([]byte, error) {
+	type obstacle Obstacle
+	return marshalObject(obstacle(o), o.raw)
+}
+
+func (o *TimeObject) UnmarshalJSON(data []byte) error {
+	type timeObject TimeObject
+	return unmarshalObject(data, (*timeObject)(o), &o.raw)
+}
+
+func (o TimeObject) MarshalJSON() ([]byte, error) {
+	type timeObject TimeObject
+	return marshalObject(timeObject(o), o.raw)
+}
+
+func (s *Slider) UnmarshalJSON(data []byte) error {
+	type slider Slider
+	return unmarshalObject(data, (*slider)(s), &s.raw)
+}
+
+func (s Slider) MarshalJSON() ([]byte, error) {
+	type slider Slider
+	return marshalObject(slider(s), s.raw)
+}
+
+func (c *BPMChange) UnmarshalJSON(data []byte) error {
+	type bpmChange BPMChange
+	return unmarshalObject(data, (*bpmChange)(c), &c.raw)
+}
+
+func (c BPMChange) MarshalJSON() ([]byte, error) {
+	type bpmChange BPMChange
+	return marshalObject(bpmChange(c), c.raw)
+}
+
+func (d *BeatMapCustomData) UnmarshalJSON(data []byte) error {
+	type beatMapCustomData BeatMapCustomData
+	return unmarshalObject(data, (*beatMapCustomData)(d), &d.raw)
+}
+
+func (d BeatMapCustomData) MarshalJSON() ([]byte, error) {
+	type beatMapCustomData BeatMapCustomData
+	return marshalObject(beatMapCustomData(d), d.raw)
 }
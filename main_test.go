@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestBeatMapTempoChangesLeavesBPMChanges(t *testing.T) {
+	// Spare capacity is what let the custom data's changes be appended into
+	// the map's own list.
+	bpmChanges := make([]BPMChange, 1, 4)
+	bpmChanges[0] = BPMChange{Time: 4, BPM: 120}
+	b := &BeatMap{
+		BPMChanges: bpmChanges,
+		CustomData: &BeatMapCustomData{BPMChanges: []BPMChange{{Time: 8, BPM: 90}}},
+	}
+	if got := len(b.TempoChanges()); got != 2 {
+		t.Errorf("got %d tempo changes, want 2", got)
+	}
+	if got := bpmChanges[:2][1]; got.Time != 0 || got.BPM != 0 {
+		t.Errorf("TempoChanges wrote %v past the end of _BPMChanges", got)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// meter is a time signature: Count notes of value 1/Note to the bar.
+type meter struct {
+	Count int
+	Note  int
+}
+
+func (m meter) String() string {
+	return strconv.Itoa(m.Count) + "/" + strconv.Itoa(m.Note)
+}
+
+func parseMeter(text string) (meter, error) {
+	parts := strings.Split(strings.TrimSpace(text), "/")
+	if len(parts) != 2 {
+		return meter{}, fmt.Errorf("time signature '%s': must look like 6/8", text)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || count <= 0 {
+		return meter{}, fmt.Errorf("time signature '%s': invalid number of beats '%s'", text, parts[0])
+	}
+	note, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || note <= 0 || note&(note-1) != 0 {
+		return meter{}, fmt.Errorf("time signature '%s': the note value must be 1, 2, 4, 8, 16 and so on", text)
+	}
+	return meter{Count: count, Note: note}, nil
+}
+
+// compound reports whether the meter is felt in dotted beats of three notes
+// each, like 6/8, 9/8 and 12/8.
+func (m meter) compound() bool {
+	return m.Count > 3 && m.Count%3 == 0 && m.Note >= 8
+}
+
+// beatsPerBar returns how many beats a bar of the song has, counting the
+// dotted beats of a compound meter.
+func (m meter) beatsPerBar() int {
+	if m.compound() {
+		return m.Count / 3
+	}
+	return m.Count
+}
+
+// beat returns the length of one of the song's beats, in whole notes.
+func (m meter) beat() *big.Rat {
+	if m.compound() {
+		return big.NewRat(3, int64(m.Note))
+	}
+	return big.NewRat(1, int64(m.Note))
+}
+
+// meterRatio returns the BPM ratio that turns a chart made in an editor that
+// assumed the editor meter into one in the song's real meter, provided the
+// notes were charted at their written length. Editors know nothing of
+// compound meters, so an editor beat is always one 1/Note note, whereas the
+// song's beat is dotted in a compound meter. For a 6/8 song charted with
+// the eighth notes as beats, that is a 6/8 editor meter and a ratio of 1/3.
+// An unset editor meter is taken to be the song's.
+func meterRatio(song, editor meter) *big.Rat {
+	if editor.Count == 0 {
+		editor = song
+	}
+	editorBeat := big.NewRat(1, int64(editor.Note))
+	return editorBeat.Quo(editorBeat, song.beat())
+}
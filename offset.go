@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// The offset modes say what a conversion does with a difficulty's offset
+// (DifficultyLevel.Offset, in milliseconds).
+const (
+	// offsetKeep leaves the offset as it is; objects keep their time
+	// relative to it.
+	offsetKeep = ""
+	// offsetBake moves every object by the offset and sets it to 0, for
+	// editors and game versions that ignore it.
+	offsetBake = "bake"
+	// offsetExtract moves every object back by the whole beats of silence
+	// before the first one and puts the time into the offset instead.
+	offsetExtract = "extract"
+)
+
+func parseOffsetMode(text string) (string, error) {
+	switch text {
+	case "keep":
+		return offsetKeep, nil
+	case offsetBake, offsetExtract:
+		return text, nil
+	}
+	return "", fmt.Errorf("unknown offset mode '%s', must be keep, bake or extract", text)
+}
+
+// shiftConverter moves every beat another converter returns by shift beats.
+type shiftConverter struct {
+	beatConverter
+	shift float64
+}
+
+func (c shiftConverter) Beat(beat float64) float64 {
+	return c.beatConverter.Beat(beat) + c.shift
+}
+
+// offsetShift returns how many beats at outputBPM a difficulty's objects
+// move in the given mode, and the offset that keeps them at the same time
+// in the song. first is the output beat of the difficulty's first object or
+// tempo change.
+//
+// The offset delays every object, as it does in the game: an object at beat
+// b plays at b*60/bpm seconds plus offset milliseconds, as in tempoMap. So
+// baking a positive offset moves the objects later, and extracting a lead-in
+// moves them earlier and adds its length to the offset.
+func offsetShift(mode string, offset int, outputBPM float64, first float64) (float64, int) {
+	switch mode {
+	case offsetBake:
+		return float64(offset) * outputBPM / 60000, 0
+	case offsetExtract:
+		// Whole beats keep the objects on the editor's grid. The offset is
+		// rounded to the millisecond, which the verification allows for.
+		lead := math.Floor(first)
+		if lead <= 0 {
+			return 0, offset
+		}
+		return -lead, offset + int(math.Round(lead*60000/outputBPM))
+	}
+	return 0, offset
+}
+
+// firstBeat returns the earliest beat of times and changes, or 0 if there
+// are none.
+func firstBeat(times beatTimes, changes []tempoChange) float64 {
+	beats := times.all()
+	for _, change := range changes {
+		beats = append(beats, change.Beat)
+	}
+	if len(beats) == 0 {
+		return 0
+	}
+	first := beats[0]
+	for _, beat := range beats[1:] {
+		first = math.Min(first, beat)
+	}
+	return first
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestOffsetShift(t *testing.T) {
+	tests := []struct {
+		mode      string
+		offset    int
+		bpm       float64
+		first     float64
+		shift     float64
+		newOffset int
+	}{
+		{offsetKeep, 500, 120, 4, 0, 500},
+		// 500 ms is a beat at 120 BPM, which the objects now wait for
+		// themselves.
+		{offsetBake, 500, 120, 4, 1, 0},
+		{offsetBake, -250, 120, 4, -0.5, 0},
+		{offsetBake, 0, 120, 4, 0, 0},
+		// A 4 beat lead-in at 120 BPM is 2 seconds of delay.
+		{offsetExtract, 500, 120, 4, -4, 2500},
+		{offsetExtract, 0, 120, 4, -4, 2000},
+		// Only whole beats are extracted, to stay on the grid.
+		{offsetExtract, 0, 120, 4.5, -4, 2000},
+		{offsetExtract, 0, 90, 2.25, -2, 1333},
+		// Nothing before the first beat to take out.
+		{offsetExtract, 300, 120, 0.75, 0, 300},
+		{offsetExtract, 300, 120, 0, 0, 300},
+		{offsetExtract, 300, 120, -1, 0, 300},
+	}
+	for _, test := range tests {
+		shift, newOffset := offsetShift(test.mode, test.offset, test.bpm, test.first)
+		if shift != test.shift || newOffset != test.newOffset {
+			t.Errorf("offsetShift(%q, %d, %v, %v) = %v, %d, want %v, %d", test.mode, test.offset, test.bpm, test.first, shift, newOffset, test.shift, test.newOffset)
+		}
+	}
+}
+
+func TestParseOffsetMode(t *testing.T) {
+	for text, want := range map[string]string{"keep": offsetKeep, "bake": offsetBake, "extract": offsetExtract} {
+		if got, err := parseOffsetMode(text); err != nil || got != want {
+			t.Errorf("parseOffsetMode(%q) = %q, %v, want %q", text, got, err, want)
+		}
+	}
+	if _, err := parseOffsetMode("zero"); err == nil {
+		t.Error("parseOffsetMode accepted 'zero'")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// songPath joins relativePath, as found in a song info file, onto folder.
+// Songs are downloaded from strangers, so anything that would lead outside
+// the folder is refused: absolute paths, "..", and symlinks that point
+// somewhere else.
+func songPath(folder, relativePath string) (string, error) {
+	if relativePath == "" {
+		return "", errors.New("empty file name")
+	}
+	if filepath.IsAbs(relativePath) || filepath.VolumeName(relativePath) != "" || strings.HasPrefix(relativePath, "/") || strings.HasPrefix(relativePath, `\`) {
+		return "", fmt.Errorf("'%s' is an absolute path", relativePath)
+	}
+	if leavesFolder(filepath.Clean(relativePath)) {
+		return "", fmt.Errorf("'%s' leads outside the song folder", relativePath)
+	}
+
+	joined := filepath.Join(folder, relativePath)
+	root, err := resolveExisting(folder)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := resolveExisting(joined)
+	if err != nil {
+		return "", fmt.Errorf("'%s': %s", relativePath, err)
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || leavesFolder(rel) {
+		return "", fmt.Errorf("'%s' leads outside the song folder through a symlink", relativePath)
+	}
+	return joined, nil
+}
+
+// leavesFolder reports whether the clean relative path rel climbs out of the
+// folder it is relative to.
+func leavesFolder(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel)
+}
+
+// resolveExisting follows the symlinks in filePath as far as it exists; the
+// rest, which is yet to be written, is appended as is.
+func resolveExisting(filePath string) (string, error) {
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(filePath)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if _, lerr := os.Lstat(filePath); lerr == nil || !os.IsNotExist(err) {
+			// A symlink that points nowhere exists but can't be resolved.
+			return "", err
+		}
+		parent := filepath.Dir(filePath)
+		if parent == filePath {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(filePath), rest)
+		filePath = parent
+	}
+}
+
+// checkSongPaths makes sure that every file the song info refers to stays
+// inside both the input and the output folder, before anything is read or
+// written.
+func checkSongPaths(inputs *inputFields, songInfo songInfoFile) error {
+	check := func(relativePath string) error {
+		if _, err := songPath(inputs.InputFolder, relativePath); err != nil {
+			return err
+		}
+		_, err := songPath(inputs.OutputFolder, relativePath)
+		return err
+	}
+	for _, difficultyLevel := range songInfo.Difficulties() {
+		if err := check(difficultyLevel.BeatmapPath); err != nil {
+			return fmt.Errorf("difficulty %s: beatmap: %s", difficultyLevel, err)
+		}
+		if difficultyLevel.LightshowPath == "" {
+			continue
+		}
+		if err := check(difficultyLevel.LightshowPath); err != nil {
+			return fmt.Errorf("difficulty %s: lightshow: %s", difficultyLevel, err)
+		}
+	}
+	if audioDataPath := songInfo.AudioDataPath(); audioDataPath != "" {
+		if err := check(audioDataPath); err != nil {
+			return fmt.Errorf("audio data: %s", err)
+		}
+	}
+	if inputs.FullSong {
+		for _, asset := range songInfo.Assets() {
+			if asset == "" {
+				continue
+			}
+			if err := check(asset); err != nil {
+				return fmt.Errorf("song asset: %s", err)
+			}
+		}
+	}
+	return nil
+}
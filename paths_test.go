@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newSongTree creates a song folder with symlinks that stay inside it and
+// ones that lead out of it, next to a folder it must not reach. It returns
+// their common parent, with symlinks resolved.
+func newSongTree(t *testing.T) string {
+	root, err := ioutil.TempDir("", "bpm-saber-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		t.Fatal(err)
+	}
+	for _, folder := range []string{"song/sub", "outside"} {
+		if err := os.MkdirAll(filepath.Join(root, folder), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"song/Expert.dat", "song/sub/Hard.dat", "outside/secret.dat"} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"song/inlink":      "sub",
+		"song/outlink":     filepath.Join(root, "outside"),
+		"song/relout":      "../outside",
+		"song/outfile.dat": filepath.Join(root, "outside", "secret.dat"),
+		"song/dangling":    filepath.Join(root, "nowhere"),
+		"songlink":         "song",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			os.RemoveAll(root)
+			t.Skip("can't create symlinks here:", err)
+		}
+	}
+	return root
+}
+
+func TestSongPath(t *testing.T) {
+	root := newSongTree(t)
+	defer os.RemoveAll(root)
+	song := filepath.Join(root, "song")
+
+	tests := []struct {
+		folder, relativePath string
+		ok                   bool
+	}{
+		{song, "Expert.dat", true},
+		{song, "sub/Hard.dat", true},
+		{song, "sub/../Expert.dat", true},
+		// Files that are yet to be written.
+		{song, "new.dat", true},
+		{song, "new/deeper/new.dat", true},
+		{song, "inlink/Hard.dat", true},
+		{song, "inlink/new.dat", true},
+		// The song folder itself may be reached through a symlink.
+		{filepath.Join(root, "songlink"), "sub/Hard.dat", true},
+
+		{song, "", false},
+		{song, filepath.Join(root, "outside", "secret.dat"), false},
+		{song, "/etc/passwd", false},
+		{song, `\Windows\win.ini`, false},
+		{song, "..", false},
+		{song, "../outside/secret.dat", false},
+		{song, "sub/../../outside/secret.dat", false},
+		{song, "outlink/secret.dat", false},
+		{song, "outlink/new.dat", false},
+		{song, "relout/secret.dat", false},
+		{song, "outfile.dat", false},
+		{song, "dangling", false},
+		{song, "dangling/new.dat", false},
+	}
+	for _, test := range tests {
+		got, err := songPath(test.folder, test.relativePath)
+		if (err == nil) != test.ok {
+			t.Errorf("songPath('%s', '%s') = '%s', %v, want ok %v", test.folder, test.relativePath, got, err, test.ok)
+			continue
+		}
+		if want := filepath.Join(test.folder, test.relativePath); err == nil && got != want {
+			t.Errorf("songPath('%s', '%s') = '%s', want '%s'", test.folder, test.relativePath, got, want)
+		}
+	}
+}
+
+func TestResolveExisting(t *testing.T) {
+	root := newSongTree(t)
+	defer os.RemoveAll(root)
+
+	tests := []struct {
+		filePath, want string
+	}{
+		{"song/Expert.dat", "song/Expert.dat"},
+		{"song/new/deeper/new.dat", "song/new/deeper/new.dat"},
+		{"song/inlink/Hard.dat", "song/sub/Hard.dat"},
+		{"song/inlink/new.dat", "song/sub/new.dat"},
+		{"song/outlink/new/new.dat", "outside/new/new.dat"},
+		{"song/relout/secret.dat", "outside/secret.dat"},
+		{"songlink/outfile.dat", "outside/secret.dat"},
+	}
+	for _, test := range tests {
+		got, err := resolveExisting(filepath.Join(root, test.filePath))
+		if want := filepath.Join(root, test.want); err != nil || got != want {
+			t.Errorf("resolveExisting('%s') = '%s', %v, want '%s'", test.filePath, got, err, want)
+		}
+	}
+	if got, err := resolveExisting(filepath.Join(root, "song", "dangling", "new.dat")); err == nil {
+		t.Errorf("resolveExisting through a dangling symlink = '%s', want an error", got)
+	}
+}
+
+func TestLeavesFolder(t *testing.T) {
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"Expert.dat", false},
+		{"..Expert.dat", false},
+		{"sub/..", false},
+		{"..", true},
+		{"../Expert.dat", true},
+	}
+	for _, test := range tests {
+		if got := leavesFolder(filepath.FromSlash(test.rel)); got != test.want {
+			t.Errorf("leavesFolder('%s') = %v, want %v", test.rel, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// beatTimes holds the beats of a beatmap's objects, in the order they
+// appear in the file.
+type beatTimes struct {
+	Notes     []float64
+	Obstacles []float64
+	Events    []float64
+}
+
+func appendBeats(beats []float64, objects []BeatObject) []float64 {
+	for _, object := range objects {
+		beats = append(beats, object.Beat)
+	}
+	return beats
+}
+
+// add appends the objects of other, for a difficulty whose lightshow is in
+// a separate file.
+func (t beatTimes) add(other beatTimes) beatTimes {
+	return beatTimes{
+		Notes:     append(append([]float64(nil), t.Notes...), other.Notes...),
+		Obstacles: append(append([]float64(nil), t.Obstacles...), other.Obstacles...),
+		Events:    append(append([]float64(nil), t.Events...), other.Events...),
+	}
+}
+
+func (t beatTimes) all() []float64 {
+	return append(append(append([]float64(nil), t.Notes...), t.Obstacles...), t.Events...)
+}
+
+// previewGrid is the beat subdivision objects are checked against. 1/48
+// covers both the usual 1/16 grid and triplets.
+const previewGrid = 48
+
+// onGrid reports whether beat is on the 1/previewGrid grid, give or take
+// the rounding that editors leave in.
+func onGrid(beat float64) bool {
+	ticks := beat * previewGrid
+	return math.Abs(ticks-math.Round(ticks)) < 0.01
+}
+
+// difficultyPreview is what a dry run reports about a difficulty, with
+// beats before the conversion at the input BPM and after it at the output
+// BPM.
+type difficultyPreview struct {
+	MovedNotes     int     `json:"movedNotes"`
+	MovedObstacles int     `json:"movedObstacles"`
+	MovedEvents    int     `json:"movedEvents"`
+	FirstBefore    float64 `json:"firstBeatBefore"`
+	LastBefore     float64 `json:"lastBeatBefore"`
+	FirstAfter     float64 `json:"firstBeatAfter"`
+	LastAfter      float64 `json:"lastBeatAfter"`
+	// OffGrid counts objects that were on the 1/48 beat grid before the
+	// conversion and aren't after it. OffGridBeats lists the first few of
+	// them, at their new beat.
+	OffGrid      int       `json:"offGrid"`
+	OffGridBeats []float64 `json:"offGridBeats,omitempty"`
+}
+
+// maxOffGridBeats limits how many off-grid objects a preview lists.
+const maxOffGridBeats = 10
+
+func newDifficultyPreview(before, after beatTimes) *difficultyPreview {
+	p := &difficultyPreview{
+		MovedNotes:     countMoved(before.Notes, after.Notes),
+		MovedObstacles: countMoved(before.Obstacles, after.Obstacles),
+		MovedEvents:    countMoved(before.Events, after.Events),
+	}
+	p.FirstBefore, p.LastBefore = beatRange(before.all())
+	p.FirstAfter, p.LastAfter = beatRange(after.all())
+
+	beforeAll, afterAll := before.all(), after.all()
+	for i := 0; i < len(beforeAll) && i < len(afterAll); i++ {
+		if onGrid(beforeAll[i]) && !onGrid(afterAll[i]) {
+			p.OffGrid++
+			p.OffGridBeats = append(p.OffGridBeats, afterAll[i])
+		}
+	}
+	sort.Float64s(p.OffGridBeats)
+	if len(p.OffGridBeats) > maxOffGridBeats {
+		p.OffGridBeats = p.OffGridBeats[:maxOffGridBeats]
+	}
+	return p
+}
+
+// countMoved counts the objects whose beat changed. Objects the conversion
+// added or removed, such as BPM change markers, count as moved.
+func countMoved(before, after []float64) int {
+	moved := 0
+	for i := 0; i < len(before) && i < len(after); i++ {
+		if before[i] != after[i] {
+			moved++
+		}
+	}
+	if len(before) > len(after) {
+		return moved + len(before) - len(after)
+	}
+	return moved + len(after) - len(before)
+}
+
+func beatRange(beats []float64) (first, last float64) {
+	for i, beat := range beats {
+		if i == 0 || beat < first {
+			first = beat
+		}
+		if i == 0 || beat > last {
+			last = beat
+		}
+	}
+	return first, last
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// rawObject remembers every key of a JSON object, in order, with its value
+// as it appeared in the source file. The beatmap and song info types keep
+// one alongside their typed fields so that anything bpm-saber doesn't model
+// (_customData, _bookmarks, mod data, ...) survives a load and save with the
+// same keys in the same order and the same values, and only the fields the
+// tool actually changed are rewritten. Values are written back compacted,
+// as encoding/json does with anything a MarshalJSON returns, so whitespace
+// isn't kept, but the text of every value is: 1.0 stays 1.0 and "\u00e9"
+// stays escaped.
+type rawObject struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+// unmarshalObject decodes data into v and records the raw object in raw.
+// v must not be the type that calls unmarshalObject from its own
+// UnmarshalJSON, or the call would recurse; pass an alias type instead.
+func unmarshalObject(data []byte, v interface{}, raw *rawObject) error {
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return wrapNestedError(data, err)
+	}
+	*raw = rawObject{values: map[string]json.RawMessage{}}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("unexpected object key %v", tok)
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		if _, seen := raw.values[key]; !seen {
+			raw.keys = append(raw.keys, key)
+		}
+		raw.values[key] = value
+	}
+	return nil
+}
+
+// has reports whether the source file had key.
+func (r rawObject) has(key string) bool {
+	_, ok := r.values[key]
+	return ok
+}
+
+// include makes marshalObject write key from the typed value even though the
+// source file didn't have it, for fields the tool adds to a file. Objects
+// that weren't loaded from a file write every field anyway.
+func (r *rawObject) include(key string) {
+	if r.values == nil {
+		return
+	}
+	if _, ok := r.values[key]; ok {
+		return
+	}
+	r.keys = append(r.keys, key)
+	r.values[key] = nil
+}
+
+// marshalObject encodes v on top of raw. Keys from the source file keep
+// their order and their original value, compacted, unless v holds a
+// different value for them. Keys that v knows about but the source file didn't have are left
+// out unless they were added with include, so saving a file doesn't change
+// its schema by accident. When raw is empty (the object wasn't loaded from a
+// file) v is encoded as is.
+func marshalObject(v interface{}, raw rawObject) ([]byte, error) {
+	typed, err := marshalNoEscape(v)
+	if err != nil {
+		return nil, err
+	}
+	if raw.values == nil {
+		return typed, nil
+	}
+	typedValues := map[string]json.RawMessage{}
+	if err := json.Unmarshal(typed, &typedValues); err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for _, key := range raw.keys {
+		value := raw.values[key]
+		newValue, ok := typedValues[key]
+		switch {
+		case value == nil && !ok:
+			continue
+		case value == nil:
+			value = newValue
+		case ok:
+			same, err := sameJSON(value, newValue)
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				value = newValue
+			}
+		}
+
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		encodedKey, err := marshalNoEscape(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encodedKey)
+		buf.WriteByte(':')
+		if err := json.Compact(buf, value); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// marshalNoEscape is json.Marshal without the HTML escaping, which would
+// otherwise turn "&" in song names into "\u0026".
+func marshalNoEscape(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// sameJSON reports whether a and b encode the same value, ignoring
+// formatting differences such as whitespace or 1 vs 1.0.
+func sameJSON(a, b json.RawMessage) (bool, error) {
+	if bytes.Equal(a, b) {
+		return true, nil
+	}
+	var av, bv interface{}
+	if err := json.Unmarshal(a, &av); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, &bv); err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(av, bv), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// moddedBeatmap has keys bpm-saber doesn't model at every level, pretty
+// printed, with number and string literals that a decode and encode would
+// spell differently.
+const moddedBeatmap = `{
+	"_version": "2.0.0",
+	"_notes": [
+		{
+			"_time": 4.0,
+			"_lineIndex": 1,
+			"_lineLayer": 0,
+			"_type": 0,
+			"_cutDirection": 1,
+			"_customData": {"_color": [1, 0.5, 0], "_track": "café & co"}
+		}
+	],
+	"_events": [],
+	"_obstacles": [],
+	"_bookmarks": [{"_time": 8, "_name": "drop"}],
+	"_customData": {
+		"_environment": [{"_id": "Spectrograms", "_active": false}],
+		"_pointDefinitions": [{"_name": "p", "_points": [[0, 0, 0, 0], [1e2, 0, 0, 1]]}]
+	}
+}`
+
+func TestBeatMapRoundTrip(t *testing.T) {
+	var b BeatMap
+	if err := json.Unmarshal([]byte(moddedBeatmap), &b); err != nil {
+		t.Fatal(err)
+	}
+	want := &bytes.Buffer{}
+	if err := json.Compact(want, []byte(moddedBeatmap)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := marshalNoEscape(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want.String() {
+		t.Errorf("unchanged beatmap:\ngot  %s\nwant %s", got, want)
+	}
+
+	// Changing a time rewrites that value and nothing else.
+	b.Notes[0].Time = 2
+	got, err = marshalNoEscape(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed := strings.Replace(want.String(), `"_time":4.0`, `"_time":2`, 1); string(got) != changed {
+		t.Errorf("converted beatmap:\ngot  %s\nwant %s", got, changed)
+	}
+}
+
+func TestMarshalObjectLeavesOutNewKeys(t *testing.T) {
+	var b BeatMap
+	if err := json.Unmarshal([]byte(`{"_version":"2.0.0","_notes":[]}`), &b); err != nil {
+		t.Fatal(err)
+	}
+	b.BeatsPerBar = 4
+	got, err := marshalNoEscape(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"_version":"2.0.0","_notes":[]}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	b.raw.include("_beatsPerBar")
+	got, err = marshalNoEscape(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"_version":"2.0.0","_notes":[],"_beatsPerBar":4}`; string(got) != want {
+		t.Errorf("with include: got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A difficulty filter picks difficulties to convert. "Standard/ExpertPlus"
+// picks a single difficulty, "ExpertPlus" picks it in every characteristic,
+// and "Standard/*" picks every difficulty of a characteristic. Filters are
+// not case sensitive.
+func filterMatches(filter string, d difficulty) bool {
+	filter = strings.TrimSpace(filter)
+	slash := strings.Index(filter, "/")
+	if slash < 0 {
+		return strings.EqualFold(filter, d.Name)
+	}
+	characteristic, name := filter[:slash], filter[slash+1:]
+	return strings.EqualFold(characteristic, d.Characteristic) && (name == "*" || strings.EqualFold(name, d.Name))
+}
+
+// isSelected reports whether d should be converted. No filters means every
+// difficulty is.
+func isSelected(inputs *inputFields, d difficulty) bool {
+	if len(inputs.Difficulties) == 0 {
+		return true
+	}
+	for _, filter := range inputs.Difficulties {
+		if filterMatches(filter, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSelection makes sure every filter picks at least one difficulty, so
+// that a typo doesn't quietly convert nothing.
+func checkSelection(inputs *inputFields, songInfo songInfoFile) error {
+	for _, filter := range inputs.Difficulties {
+		found := false
+		for _, d := range songInfo.Difficulties() {
+			found = found || filterMatches(filter, d)
+		}
+		if !found {
+			return fmt.Errorf("no difficulty matches '%s'", filter)
+		}
+	}
+	return nil
+}
+
+// checkSharedOffsets fails if difficulties that share a beatmap have
+// different offsets. The beatmap can only be converted for one of them, and
+// the others would have their offsets quietly rewritten to match.
+func checkSharedOffsets(selected []difficulty) error {
+	first := map[string]difficulty{}
+	for _, d := range selected {
+		other, ok := first[d.BeatmapPath]
+		if !ok {
+			first[d.BeatmapPath] = d
+			continue
+		}
+		if other.Offset != d.Offset {
+			return fmt.Errorf("%s and %s share %s but have different offsets (%d ms and %d ms)", other, d, d.BeatmapPath, other.Offset, d.Offset)
+		}
+	}
+	return nil
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestCheckSharedOffsets(t *testing.T) {
+	expert := difficulty{Name: "Expert", BeatmapPath: "Expert.json", Offset: 100}
+	tests := []struct {
+		selected []difficulty
+		ok       bool
+	}{
+		{nil, true},
+		{[]difficulty{expert}, true},
+		{[]difficulty{expert, {Name: "Hard", BeatmapPath: "Hard.json", Offset: 250}}, true},
+		{[]difficulty{expert, {Name: "ExpertPlus", BeatmapPath: "Expert.json", Offset: 100}}, true},
+		{[]difficulty{expert, {Name: "ExpertPlus", BeatmapPath: "Expert.json", Offset: 250}}, false},
+	}
+	for _, test := range tests {
+		err := checkSharedOffsets(test.selected)
+		if (err == nil) != test.ok {
+			t.Errorf("checkSharedOffsets(%v) = %v, want ok %v", test.selected, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "math"
+
+// snapConverter rounds the beats another converter returns to the nearest
+// 1/grid beat, so that objects land exactly on the editor's grid, and keeps
+// track of the largest rounding it did.
+type snapConverter struct {
+	beatConverter
+	grid     float64
+	maxError float64
+}
+
+func newSnapConverter(c beatConverter, grid int) *snapConverter {
+	return &snapConverter{beatConverter: c, grid: float64(grid)}
+}
+
+func (c *snapConverter) snap(beat float64) float64 {
+	snapped := math.Round(beat*c.grid) / c.grid
+	c.maxError = math.Max(c.maxError, math.Abs(snapped-beat))
+	return snapped
+}
+
+func (c *snapConverter) Beat(beat float64) float64 {
+	return c.snap(c.beatConverter.Beat(beat))
+}
+
+// Duration snaps both ends, so that the end lands on the grid too.
+func (c *snapConverter) Duration(beat, duration float64) float64 {
+	start := c.beatConverter.Beat(beat)
+	return c.snap(start+c.beatConverter.Duration(beat, duration)) - c.snap(start)
+}
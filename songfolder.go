@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// writeSongFolder completes the output folder after the difficulties have
+// been written: every asset the song info refers to is copied (or hard
+// linked) over, and the song info itself is saved with the output BPM, so
+// the folder loads in game as is.
+func writeSongFolder(inputs *inputFields, songInfo songInfoFile, tx *outputTransaction) error {
+	seen := map[string]bool{}
+	for _, asset := range songInfo.Assets() {
+		if asset == "" || seen[asset] {
+			continue
+		}
+		seen[asset] = true
+		src := filepath.Join(inputs.InputFolder, asset)
+		if sameFile(src, filepath.Join(inputs.OutputFolder, asset)) {
+			continue
+		}
+		if err := tx.CopyFile(src, asset, inputs.LinkAssets); err != nil {
+			return err
+		}
+	}
+	songInfo.SetBPM(inputs.OutputBPM)
+	return saveSongInfo(tx, songInfo)
+}
+
+// unusedName returns a name next to relativePath, like
+// Lightshow.unconverted.dat, that neither the song info, the names in
+// clones, nor a file in the input or output folder already uses.
+func unusedName(inputs *inputFields, songInfo songInfoFile, clones map[string]string, relativePath string) string {
+	taken := map[string]bool{songInfo.FileName(): true, songInfo.AudioDataPath(): true}
+	for _, asset := range songInfo.Assets() {
+		taken[asset] = true
+	}
+	for _, d := range songInfo.Difficulties() {
+		taken[d.BeatmapPath] = true
+		taken[d.LightshowPath] = true
+	}
+	for _, clone := range clones {
+		taken[clone] = true
+	}
+	ext := filepath.Ext(relativePath)
+	stem := strings.TrimSuffix(relativePath, ext) + ".unconverted"
+	for n := 1; ; n++ {
+		name := stem + ext
+		if n > 1 {
+			name = stem + strconv.Itoa(n) + ext
+		}
+		if taken[name] {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(inputs.InputFolder, name)); !os.IsNotExist(err) {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(inputs.OutputFolder, name)); !os.IsNotExist(err) {
+			continue
+		}
+		return name
+	}
+}
+
+// sameFile reports whether a and b both exist and are the same file, as when
+// converting a song in place.
+func sameFile(a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	return err == nil && os.SameFile(aInfo, bInfo)
+}
+
+// copyAsset copies src to dst. If link is set it tries a hard link first,
+// which is instant and takes no extra space, and falls back to copying when
+// the two folders are on different drives.
+func copyAsset(src, dst string, link bool) error {
+	if sameFile(src, dst) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if link {
+		os.Remove(dst)
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ratioCandidate is a BPM ratio that suggestRatios considered.
+type ratioCandidate struct {
+	Ratio     *big.Rat
+	OutputBPM float64
+	Score     float64
+	// Confidence is the candidate's share of the scores of all candidates.
+	Confidence float64
+}
+
+// candidateRatios returns every ratio with a numerator and denominator of
+// at most 4, which covers charting at ×2, ×3, ×3/2 and so on.
+func candidateRatios() []*big.Rat {
+	var ratios []*big.Rat
+	seen := map[string]bool{}
+	for numerator := int64(1); numerator <= 4; numerator++ {
+		for denominator := int64(1); denominator <= 4; denominator++ {
+			ratio := big.NewRat(numerator, denominator)
+			if !seen[ratio.String()] {
+				seen[ratio.String()] = true
+				ratios = append(ratios, ratio)
+			}
+		}
+	}
+	sort.Slice(ratios, func(i, j int) bool { return ratios[i].Cmp(ratios[j]) < 0 })
+	return ratios
+}
+
+// subdivisionWeights says how natural a note on each subdivision of the beat
+// is, coarsest first. Notes that are on none of them count for nothing.
+var subdivisionWeights = []struct {
+	parts  int
+	weight float64
+}{
+	{1, 1}, {2, 0.9}, {3, 0.8}, {4, 0.8}, {6, 0.65}, {8, 0.65}, {12, 0.5}, {16, 0.5},
+}
+
+// gridFit scores how well beats land on the common subdivisions of the
+// beat, from 0 to 1.
+func gridFit(beats []float64) float64 {
+	total := 0.0
+	for _, beat := range beats {
+		for _, subdivision := range subdivisionWeights {
+			ticks := beat * float64(subdivision.parts)
+			if math.Abs(ticks-math.Round(ticks)) < 0.01 {
+				total += subdivision.weight
+				break
+			}
+		}
+	}
+	return total / float64(len(beats))
+}
+
+// typicalBPM and tempoSpread describe the tempos songs are usually charted
+// at: tempoSpread is in natural log units, so a song 1.4 times faster or
+// slower than typicalBPM is one spread away.
+const (
+	typicalBPM  = 130
+	tempoSpread = 0.35
+)
+
+// tempoFit scores how plausible bpm is as the real tempo of a song, from 0
+// to 1. Any ratio can put the notes on a grid, so this is what tells ×1/3
+// from ×1 when a song was charted at three times its tempo.
+func tempoFit(bpm float64) float64 {
+	x := math.Log(bpm / typicalBPM)
+	return math.Exp(-x * x / (2 * tempoSpread * tempoSpread))
+}
+
+// suggestRatios scores every candidate ratio for notes, charted at
+// inputBPM, by how well the converted notes land on the grid and how
+// plausible the output BPM is. The best candidate comes first.
+func suggestRatios(notes []float64, inputBPM float64) ([]ratioCandidate, error) {
+	if len(notes) == 0 {
+		return nil, errors.New("no notes to go by")
+	}
+	var candidates []ratioCandidate
+	total := 0.0
+	for _, ratio := range candidateRatios() {
+		r, _ := ratio.Float64()
+		converted := make([]float64, len(notes))
+		for i, note := range notes {
+			converted[i] = note * r
+		}
+		candidate := ratioCandidate{Ratio: ratio, OutputBPM: convertTime(inputBPM, ratio)}
+		candidate.Score = gridFit(converted) * tempoFit(candidate.OutputBPM)
+		total += candidate.Score
+		candidates = append(candidates, candidate)
+	}
+	if total == 0 {
+		return nil, errors.New("the notes don't fit any ratio")
+	}
+	for i := range candidates {
+		candidates[i].Confidence = candidates[i].Score / total
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Score > candidates[j].Score })
+	return candidates, nil
+}
+
+// loadNoteBeats returns the beats of the notes of every difficulty of the
+// song in folder.
+func loadNoteBeats(folder string) ([]float64, error) {
+	songInfo, err := loadSongInfo(folder)
+	if err != nil {
+		return nil, err
+	}
+	var notes []float64
+	loaded := map[string]bool{}
+	for _, difficultyLevel := range songInfo.Difficulties() {
+		if loaded[difficultyLevel.BeatmapPath] {
+			continue
+		}
+		loaded[difficultyLevel.BeatmapPath] = true
+		beatmapPath, err := songPath(folder, difficultyLevel.BeatmapPath)
+		if err != nil {
+			return nil, fmt.Errorf("difficulty %s: beatmap: %s", difficultyLevel, err)
+		}
+		beatMap, err := loadBeatmap(beatmapPath)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, beatMap.Times().Notes...)
+	}
+	return notes, nil
+}
+
+// suggestForFolder suggests ratios for the song in folder. An inputBPM of 0
+// means the song info's BPM.
+func suggestForFolder(folder string, inputBPM float64) ([]ratioCandidate, float64, error) {
+	if inputBPM == 0 {
+		bpm, err := loadBpmFromFolder(folder)
+		if err != nil {
+			return nil, 0, err
+		}
+		inputBPM = bpm
+	}
+	notes, err := loadNoteBeats(folder)
+	if err != nil {
+		return nil, 0, err
+	}
+	candidates, err := suggestRatios(notes, inputBPM)
+	if err != nil {
+		return nil, 0, fmt.Errorf("song '%s': %s", folder, err)
+	}
+	return candidates, inputBPM, nil
+}
+
+// maxPrintedCandidates limits how many runners-up printSuggestions lists.
+const maxPrintedCandidates = 5
+
+func printSuggestions(w io.Writer, inputBPM float64, candidates []ratioCandidate) {
+	best := candidates[0]
+	fmt.Fprintf(w, "suggested ratio %s: %s BPM -> %s BPM, confidence %.0f%%\n", best.Ratio.RatString(), floatToString(inputBPM), floatToString(best.OutputBPM), best.Confidence*100)
+	for i, candidate := range candidates {
+		if i == maxPrintedCandidates {
+			break
+		}
+		fmt.Fprintf(w, "  %-4s %8s BPM  %3.0f%%\n", candidate.Ratio.RatString(), floatToString(candidate.OutputBPM), candidate.Confidence*100)
+	}
+}
+
+// runSuggest handles the "suggest" subcommand.
+func runSuggest(args []string) error {
+	fs := flag.NewFlagSet("suggest", flag.ContinueOnError)
+	inputFolder := fs.String("inputFolder", "", "song folder to analyze")
+	inputBPM := fs.Float64("inputBPM", 0, "BPM the song was charted at, if not the song info's")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("suggest: unexpected argument '%s'", fs.Arg(0))
+	}
+	if *inputFolder == "" {
+		return errors.New("suggest: missing required flag -inputFolder")
+	}
+	if *inputBPM < 0 {
+		return errors.New("suggest: -inputBPM must be > 0")
+	}
+	candidates, bpm, err := suggestForFolder(filepath.Clean(*inputFolder), *inputBPM)
+	if err != nil {
+		return err
+	}
+	printSuggestions(os.Stdout, bpm, candidates)
+	return nil
+}
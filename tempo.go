@@ -0,0 +1,159 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+)
+
+// tempoChange is a BPM change marker: from Beat on, beats last 60/BPM
+// seconds.
+type tempoChange struct {
+	Beat float64
+	BPM  float64
+}
+
+// tempoMap turns beat positions into seconds for songs whose tempo changes
+// part way through. Beats before the first change run at bpm. offset is the
+// difficulty offset in milliseconds, as in DifficultyLevel.Offset, which
+// delays every object by that much.
+type tempoMap struct {
+	bpm      float64
+	changes  []tempoChange
+	offset   int
+	segments []tempoSegment
+}
+
+func newTempoMap(bpm float64, changes []tempoChange, offset int) tempoMap {
+	sorted := make([]tempoChange, 0, len(changes))
+	for _, change := range changes {
+		if change.BPM > 0 {
+			sorted = append(sorted, change)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Beat < sorted[j].Beat })
+
+	segments := []tempoSegment{{beat: 0, seconds: float64(offset) / 1000, bpm: bpm}}
+	for _, change := range sorted {
+		last := segments[len(segments)-1]
+		if change.Beat <= last.beat {
+			segments[len(segments)-1].bpm = change.BPM
+			continue
+		}
+		seconds := last.seconds + (change.Beat-last.beat)*60/last.bpm
+		segments = append(segments, tempoSegment{beat: change.Beat, seconds: seconds, bpm: change.BPM})
+	}
+	return tempoMap{bpm: bpm, changes: sorted, offset: offset, segments: segments}
+}
+
+// tempoSegment is a stretch of constant tempo starting at beat, which falls
+// on song time seconds.
+type tempoSegment struct {
+	beat    float64
+	seconds float64
+	bpm     float64
+}
+
+// segmentAt returns the index of the segment beat falls in.
+func (m tempoMap) segmentAt(beat float64) int {
+	i := 0
+	for i+1 < len(m.segments) && m.segments[i+1].beat <= beat {
+		i++
+	}
+	return i
+}
+
+// Seconds returns the song time of beat.
+func (m tempoMap) Seconds(beat float64) float64 {
+	segment := m.segments[m.segmentAt(beat)]
+	return segment.seconds + (beat-segment.beat)*60/segment.bpm
+}
+
+// Beat returns the beat at song time seconds.
+func (m tempoMap) Beat(seconds float64) float64 {
+	segment := m.segments[0]
+	for _, next := range m.segments[1:] {
+		if next.seconds > seconds {
+			break
+		}
+		segment = next
+	}
+	return segment.beat + (seconds-segment.seconds)*segment.bpm/60
+}
+
+// scaled returns the tempo map of the same song with every beat multiplied
+// by ratio, which is what a constant BPM ratio conversion does to the
+// markers.
+func (m tempoMap) scaled(ratio *big.Rat) tempoMap {
+	changes := make([]tempoChange, len(m.changes))
+	for i, change := range m.changes {
+		changes[i] = tempoChange{Beat: convertTime(change.Beat, ratio), BPM: convertTime(change.BPM, ratio)}
+	}
+	return newTempoMap(convertTime(m.bpm, ratio), changes, m.offset)
+}
+
+// longestBeat returns the length in seconds of the slowest beat in the map.
+func (m tempoMap) longestBeat() float64 {
+	longest := 0.0
+	for _, segment := range m.segments {
+		if beat := 60 / segment.bpm; beat > longest {
+			longest = beat
+		}
+	}
+	return longest
+}
+
+// tempoConverter converts through absolute time: a beat is placed at its
+// time in seconds under the input tempo map, and then at whichever beat
+// falls on that time under the output tempo map.
+type tempoConverter struct {
+	input  tempoMap
+	output tempoMap
+}
+
+func (c tempoConverter) Beat(beat float64) float64 {
+	return c.output.Beat(c.input.Seconds(beat))
+}
+
+func (c tempoConverter) Duration(beat, duration float64) float64 {
+	return c.Beat(beat+duration) - c.Beat(beat)
+}
+
+// Tempo scales bpm by how much the segment around beat changed tempo. The
+// output map always has the same segments as the input map, so they are
+// matched up by index rather than by converted beat, which could land a
+// hair before the marker it belongs to.
+func (c tempoConverter) Tempo(beat, bpm float64) float64 {
+	i := c.input.segmentAt(beat)
+	return bpm * c.output.segments[i].bpm / c.input.segments[i].bpm
+}
+
+// newConverter picks the converter for a difficulty. Warp anchors replace
+// the BPM ratio entirely. Otherwise songs that never leave the input BPM use
+// the plain ratio, which avoids the rounding noise of the trip through
+// seconds.
+func newConverter(inputs *inputFields, offset int, changes []tempoChange) beatConverter {
+	if len(inputs.Anchors) > 0 && !inputs.EmitBPMChanges {
+		return newWarpConverter(inputs.Anchors, inputs.OutputBPM)
+	}
+	if len(inputs.Anchors) > 0 {
+		return linearConverter{inputs.InputBPM, inputs.ratio(), 0}
+	}
+	constant := true
+	for _, change := range changes {
+		constant = constant && change.BPM == inputs.InputBPM
+	}
+	if constant {
+		return linearConverter{inputs.InputBPM, inputs.ratio(), offset}
+	}
+	input := newTempoMap(inputs.InputBPM, changes, offset)
+	return tempoConverter{input: input, output: input.scaled(inputs.ratio())}
+}
+
+// outputTempoChanges returns the BPM change markers that replace the input's
+// markers, or nil if the converted input markers should be kept.
+func outputTempoChanges(inputs *inputFields) []tempoChange {
+	if len(inputs.Anchors) > 0 && inputs.EmitBPMChanges {
+		return warpMarkers(inputs.Anchors, inputs.InputBPM, inputs.OutputBPM)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// outputTransaction stages everything a conversion writes in a temporary
+// folder inside the output folder, so that nothing in the output changes
+// until every difficulty has been converted. commit then moves the staged
+// files into place, and puts the old ones back if any move fails, so the
+// output folder ends up either fully converted or exactly as it was.
+type outputTransaction struct {
+	folder  string
+	staging string
+	files   []string
+	staged  map[string]bool
+	// removed are the files in files that commit deletes instead of
+	// replacing.
+	removed map[string]bool
+	// lock guards files, staged and removed, which parallel conversions add
+	// to.
+	lock sync.Mutex
+}
+
+func newOutputTransaction(folder string) (*outputTransaction, error) {
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create output folder '%s': %s", folder, err)
+	}
+	staging, err := ioutil.TempDir(folder, ".bpm-saber-")
+	if err != nil {
+		return nil, err
+	}
+	return &outputTransaction{folder: folder, staging: staging, staged: map[string]bool{}, removed: map[string]bool{}}, nil
+}
+
+// newDryRunTransaction returns a transaction that only keeps track of which
+// files would be written, for previews. It touches nothing on disk.
+func newDryRunTransaction(folder string) *outputTransaction {
+	return &outputTransaction{folder: folder, staged: map[string]bool{}, removed: map[string]bool{}}
+}
+
+func (tx *outputTransaction) dryRun() bool { return tx.staging == "" }
+
+// record adds relativePath to the files tx writes.
+func (tx *outputTransaction) record(relativePath string) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if !tx.staged[relativePath] {
+		tx.staged[relativePath] = true
+		tx.files = append(tx.files, relativePath)
+	}
+}
+
+// fileChange is a file that a conversion writes.
+type fileChange struct {
+	Path      string `json:"path"`
+	Overwrite bool   `json:"overwrite"`
+}
+
+// changes lists the files tx writes, and whether each one replaces an
+// existing file.
+func (tx *outputTransaction) changes() []fileChange {
+	var changes []fileChange
+	for _, relativePath := range tx.files {
+		_, err := os.Lstat(filepath.Join(tx.folder, relativePath))
+		changes = append(changes, fileChange{Path: filepath.Join(tx.folder, relativePath), Overwrite: err == nil})
+	}
+	return changes
+}
+
+// stage returns the path that relativePath should be written to until
+// commit.
+func (tx *outputTransaction) stage(relativePath string) (string, error) {
+	if filepath.IsAbs(relativePath) || leavesFolder(filepath.Clean(relativePath)) {
+		return "", fmt.Errorf("'%s' leads outside the output folder", relativePath)
+	}
+	stagedPath := tx.stagedPath(relativePath)
+	if err := os.MkdirAll(filepath.Dir(stagedPath), 0755); err != nil {
+		return "", err
+	}
+	tx.record(relativePath)
+	return stagedPath, nil
+}
+
+// stagedPath returns where relativePath was staged.
+func (tx *outputTransaction) stagedPath(relativePath string) string {
+	return filepath.Join(tx.staging, "new", relativePath)
+}
+
+// WriteFile stages data as relativePath and flushes it to disk.
+func (tx *outputTransaction) WriteFile(relativePath string, data []byte) error {
+	if tx.dryRun() {
+		tx.record(relativePath)
+		return nil
+	}
+	stagedPath, err := tx.stage(relativePath)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(stagedPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// CopyFile stages a copy of src as relativePath and flushes it to disk. If
+// link is set it tries a hard link first, as copyAsset does.
+func (tx *outputTransaction) CopyFile(src, relativePath string, link bool) error {
+	if tx.dryRun() {
+		tx.record(relativePath)
+		return nil
+	}
+	stagedPath, err := tx.stage(relativePath)
+	if err != nil {
+		return err
+	}
+	if err := copyAsset(src, stagedPath, link); err != nil {
+		return err
+	}
+	return syncFile(stagedPath)
+}
+
+// Remove deletes relativePath from the output folder on commit, if it is
+// there.
+func (tx *outputTransaction) Remove(relativePath string) error {
+	if filepath.IsAbs(relativePath) || leavesFolder(filepath.Clean(relativePath)) {
+		return fmt.Errorf("'%s' leads outside the output folder", relativePath)
+	}
+	tx.record(relativePath)
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	tx.removed[relativePath] = true
+	return nil
+}
+
+// syncFile flushes a file to disk.
+func syncFile(filePath string) error {
+	f, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// commit moves every staged file into the output folder. Files it replaces
+// are moved aside first rather than overwritten, so that a failure part way
+// through can restore them.
+func (tx *outputTransaction) commit() error {
+	defer tx.abort()
+	var replaced, placed []string
+	rollback := func() {
+		for i := len(placed) - 1; i >= 0; i-- {
+			os.Remove(filepath.Join(tx.folder, placed[i]))
+		}
+		for i := len(replaced) - 1; i >= 0; i-- {
+			os.Rename(filepath.Join(tx.staging, "old", replaced[i]), filepath.Join(tx.folder, replaced[i]))
+		}
+	}
+	folders := map[string]bool{}
+	for _, relativePath := range tx.files {
+		dst := filepath.Join(tx.folder, relativePath)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			rollback()
+			return err
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			old := filepath.Join(tx.staging, "old", relativePath)
+			if err := os.MkdirAll(filepath.Dir(old), 0755); err != nil {
+				rollback()
+				return err
+			}
+			if err := os.Rename(dst, old); err != nil {
+				rollback()
+				return err
+			}
+			replaced = append(replaced, relativePath)
+		}
+		if tx.removed[relativePath] {
+			folders[filepath.Dir(dst)] = true
+			continue
+		}
+		if err := os.Rename(filepath.Join(tx.staging, "new", relativePath), dst); err != nil {
+			rollback()
+			return err
+		}
+		placed = append(placed, relativePath)
+		folders[filepath.Dir(dst)] = true
+	}
+	// Flushing the folders makes the renames themselves survive a crash.
+	// Not every system can open a folder for that, so failures are ignored.
+	for folder := range folders {
+		if f, err := os.Open(folder); err == nil {
+			f.Sync()
+			f.Close()
+		}
+	}
+	return nil
+}
+
+// abort throws away whatever is still staged. It does nothing after commit.
+func (tx *outputTransaction) abort() {
+	if !tx.dryRun() {
+		os.RemoveAll(tx.staging)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestTransaction returns a transaction on a new temporary folder that
+// holds files.
+func newTestTransaction(t *testing.T, files map[string]string) *outputTransaction {
+	folder := writeSong(t, files)
+	tx, err := newOutputTransaction(folder)
+	if err != nil {
+		os.RemoveAll(folder)
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// checkFolder fails unless folder holds exactly files, with no staging
+// folder left behind.
+func checkFolder(t *testing.T, folder string, files map[string]string) {
+	infos, err := ioutil.ReadDir(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != len(files) {
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		t.Errorf("folder holds %v, want %d files", names, len(files))
+	}
+	for name, want := range files {
+		got, err := ioutil.ReadFile(filepath.Join(folder, name))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if string(got) != want {
+			t.Errorf("%s holds '%s', want '%s'", name, got, want)
+		}
+	}
+	if staging, _ := filepath.Glob(filepath.Join(folder, ".bpm-saber-*")); len(staging) != 0 {
+		t.Errorf("staging folders left behind: %v", staging)
+	}
+}
+
+func TestTransactionCommit(t *testing.T) {
+	tx := newTestTransaction(t, map[string]string{"Expert.dat": "old", "Hard.dat": "old", "cover.jpg": "old"})
+	defer os.RemoveAll(tx.folder)
+	for _, relativePath := range []string{"Expert.dat", "Lightshow.dat"} {
+		if err := tx.WriteFile(relativePath, []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Remove("Hard.dat"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkFolder(t, tx.folder, map[string]string{"Expert.dat": "new", "Lightshow.dat": "new", "cover.jpg": "old"})
+}
+
+func TestTransactionRollback(t *testing.T) {
+	old := map[string]string{"Expert.dat": "old", "Hard.dat": "old"}
+	tx := newTestTransaction(t, old)
+	defer os.RemoveAll(tx.folder)
+	// Lightshow.dat is new and Expert.dat replaces a file, so both are in
+	// place by the time Hard.dat fails to move.
+	for _, relativePath := range []string{"Lightshow.dat", "Expert.dat", "Hard.dat"} {
+		if err := tx.WriteFile(relativePath, []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(tx.stagedPath("Hard.dat")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.commit(); err == nil {
+		t.Fatal("commit succeeded without Hard.dat")
+	}
+	checkFolder(t, tx.folder, old)
+}
+
+func TestTransactionAbort(t *testing.T) {
+	old := map[string]string{"Expert.dat": "old"}
+	tx := newTestTransaction(t, old)
+	defer os.RemoveAll(tx.folder)
+	if err := tx.WriteFile("Expert.dat", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.WriteFile("sub/Lightshow.dat", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	tx.abort()
+	checkFolder(t, tx.folder, old)
+}
+
+func TestTransactionRejectsEscapingPaths(t *testing.T) {
+	tx := newTestTransaction(t, nil)
+	defer os.RemoveAll(tx.folder)
+	defer tx.abort()
+	for _, relativePath := range []string{"../Expert.dat", "sub/../../Expert.dat", filepath.Join(tx.folder, "Expert.dat")} {
+		if err := tx.WriteFile(relativePath, []byte("new")); err == nil {
+			t.Errorf("WriteFile('%s') succeeded", relativePath)
+		}
+		if err := tx.Remove(relativePath); err == nil {
+			t.Errorf("Remove('%s') succeeded", relativePath)
+		}
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// The v4 layout (game version 1.34 and later) splits a difficulty into a
+// beatmap file with the gameplay objects and a lightshow file that may be
+// shared between difficulties, and moves the song's timing into a separate
+// AudioData.dat. Objects only carry a beat and an index into a data list
+// ("i"), and identical data entries are shared between objects, so anything
+// stored in a data entry that needs converting goes through sharedData.
+
+// SongInfoV4 is the v4 Info.dat layout.
+type SongInfoV4 struct {
+	Version             string                `json:"version"`
+	Audio               AudioInfoV4           `json:"audio"`
+	SongPreviewFilename string                `json:"songPreviewFilename"`
+	CoverImageFilename  string                `json:"coverImageFilename"`
+	DifficultyBeatmaps  []DifficultyBeatmapV4 `json:"difficultyBeatmaps"`
+
+	raw rawObject
+}
+
+type AudioInfoV4 struct {
+	SongFilename      string  `json:"songFilename"`
+	AudioDataFilename string  `json:"audioDataFilename"`
+	BPM               float64 `json:"bpm"`
+
+	raw rawObject
+}
+
+type DifficultyBeatmapV4 struct {
+	Characteristic        string `json:"characteristic"`
+	Difficulty            string `json:"difficulty"`
+	LightshowDataFilename string `json:"lightshowDataFilename"`
+	BeatmapDataFilename   string `json:"beatmapDataFilename"`
+
+	raw rawObject
+}
+
+func (s *SongInfoV4) FileName() string      { return "Info.dat" }
+func (s *SongInfoV4) BPM() float64          { return s.Audio.BPM }
+func (s *SongInfoV4) SetBPM(bpm float64)    { s.Audio.BPM = bpm }
+func (s *SongInfoV4) AudioDataPath() string { return s.Audio.AudioDataFilename }
+
+func (s *SongInfoV4) Assets() []string {
+	return []string{s.Audio.SongFilename, s.SongPreviewFilename, s.CoverImageFilename}
+}
+
+func (s *SongInfoV4) Difficulties() []difficulty {
+	var difficulties []difficulty
+	for _, beatmap := range s.DifficultyBeatmaps {
+		difficulties = append(difficulties, difficulty{
+			Characteristic: beatmap.Characteristic,
+			Name:           beatmap.Difficulty,
+			BeatmapPath:    beatmap.BeatmapDataFilename,
+			LightshowPath:  beatmap.LightshowDataFilename,
+			AudioPath:      s.Audio.SongFilename,
+		})
+	}
+	return difficulties
+}
+
+// SetOffset fails unless the offset stays 0, since v4 difficulties have no
+// offset of their own.
+func (s *SongInfoV4) SetOffset(d difficulty, offset int) error {
+	if offset != 0 {
+		return fmt.Errorf("difficulty %s: Info.dat v4 has no per-difficulty offset", d)
+	}
+	return nil
+}
+
+func (s *SongInfoV4) SetLightshowPath(d difficulty, relativePath string) error {
+	for i, beatmap := range s.DifficultyBeatmaps {
+		if beatmap.Characteristic == d.Characteristic && beatmap.Difficulty == d.Name {
+			s.DifficultyBeatmaps[i].LightshowDataFilename = relativePath
+			return nil
+		}
+	}
+	return fmt.Errorf("difficulty %s: not in Info.dat", d)
+}
+
+// BeatMapV4 is a v4 beatmap file. Obstacle durations live in obstaclesData.
+type BeatMapV4 struct {
+	Version        string           `json:"version"`
+	ColorNotes     []BeatObject     `json:"colorNotes"`
+	BombNotes      []BeatObject     `json:"bombNotes"`
+	Obstacles      []ObstacleV4     `json:"obstacles"`
+	ObstaclesData  []ObstacleDataV4 `json:"obstaclesData"`
+	Arcs           []HeadTailV4     `json:"arcs"`
+	Chains         []HeadTailV4     `json:"chains"`
+	SpawnRotations []BeatObject     `json:"spawnRotations"`
+	NJSEvents      []BeatObject     `json:"njsEvents"`
+
+	raw rawObject
+}
+
+type ObstacleV4 struct {
+	Beat  float64 `json:"b"`
+	Index int     `json:"i"`
+
+	raw rawObject
+}
+
+type ObstacleDataV4 struct {
+	Duration float64 `json:"d"`
+
+	raw rawObject
+}
+
+// HeadTailV4 is used for both arcs and chains.
+type HeadTailV4 struct {
+	HeadBeat float64 `json:"hb"`
+	TailBeat float64 `json:"tb"`
+
+	raw rawObject
+}
+
+func (b *BeatMapV4) Rescale(c beatConverter) {
+	originalDurations := make([]float64, len(b.ObstaclesData))
+	for i, data := range b.ObstaclesData {
+		originalDurations[i] = data.Duration
+	}
+	durations := newSharedData(func(index int, duration float64) {
+		b.ObstaclesData[index].Duration = duration
+	}, func(index int) int {
+		b.ObstaclesData = append(b.ObstaclesData, b.ObstaclesData[index])
+		return len(b.ObstaclesData) - 1
+	})
+	for i, obstacle := range b.Obstacles {
+		if obstacle.Index >= 0 && obstacle.Index < len(originalDurations) {
+			b.Obstacles[i].Index = durations.use(obstacle.Index, c.Duration(obstacle.Beat, originalDurations[obstacle.Index]))
+		}
+		b.Obstacles[i].Beat = c.Beat(obstacle.Beat)
+	}
+
+	for _, objects := range [][]BeatObject{b.ColorNotes, b.BombNotes, b.SpawnRotations, b.NJSEvents} {
+		for i, object := range objects {
+			objects[i].Beat = c.Beat(object.Beat)
+		}
+	}
+	for _, objects := range [][]HeadTailV4{b.Arcs, b.Chains} {
+		for i, object := range objects {
+			objects[i].HeadBeat = c.Beat(object.HeadBeat)
+			objects[i].TailBeat = c.Beat(object.TailBeat)
+		}
+	}
+}
+
+// SetBPM does nothing; v4 beatmaps have no BPM of their own.
+func (b *BeatMapV4) SetBPM(bpm float64) {}
+
+// SetBeatsPerBar does nothing; v4 beatmaps have no bar length.
+func (b *BeatMapV4) SetBeatsPerBar(beats int) {}
+
+// TempoChanges and SetTempoChanges do nothing; v4 tempo changes live in the
+// audio data.
+func (b *BeatMapV4) TempoChanges() []tempoChange           { return nil }
+func (b *BeatMapV4) SetTempoChanges(changes []tempoChange) {}
+
+func (b *BeatMapV4) Counts() (notes, obstacles, events int) {
+	return len(b.ColorNotes) + len(b.BombNotes), len(b.Obstacles), len(b.SpawnRotations) + len(b.NJSEvents)
+}
+
+func (b *BeatMapV4) Times() beatTimes {
+	var times beatTimes
+	times.Notes = appendBeats(appendBeats(nil, b.ColorNotes), b.BombNotes)
+	for _, obstacle := range b.Obstacles {
+		times.Obstacles = append(times.Obstacles, obstacle.Beat)
+	}
+	times.Events = appendBeats(appendBeats(nil, b.SpawnRotations), b.NJSEvents)
+	return times
+}
+
+// LightshowV4 is a v4 lightshow file. Event box groups work as in v3, except
+// that the beat distribution of each box lives in a per-type data list that
+// the group's "t" selects.
+type LightshowV4 struct {
+	Version                    string            `json:"version"`
+	Waypoints                  []BeatObject      `json:"waypoints"`
+	BasicEvents                []BeatObject      `json:"basicEvents"`
+	ColorBoostEvents           []BeatObject      `json:"colorBoostEvents"`
+	EventBoxGroups             []EventBoxGroupV4 `json:"eventBoxGroups"`
+	LightColorEventBoxes       []EventBoxDataV4  `json:"lightColorEventBoxes"`
+	LightRotationEventBoxes    []EventBoxDataV4  `json:"lightRotationEventBoxes"`
+	LightTranslationEventBoxes []EventBoxDataV4  `json:"lightTranslationEventBoxes"`
+	FXEventBoxes               []EventBoxDataV4  `json:"fxEventBoxes"`
+
+	raw rawObject
+}
+
+type EventBoxGroupV4 struct {
+	Type  int          `json:"t"`
+	Beat  float64      `json:"b"`
+	Boxes []EventBoxV4 `json:"e"`
+
+	raw rawObject
+}
+
+type EventBoxV4 struct {
+	DataIndex int          `json:"e"`
+	Events    []BeatObject `json:"l"`
+
+	raw rawObject
+}
+
+type EventBoxDataV4 struct {
+	BeatDistribution float64 `json:"w"`
+
+	raw rawObject
+}
+
+// Event box group types, used to pick the box data list.
+const (
+	lightColorEventBoxGroup       = 1
+	lightRotationEventBoxGroup    = 2
+	lightTranslationEventBoxGroup = 3
+	fxEventBoxGroup               = 4
+)
+
+func (l *LightshowV4) Rescale(c beatConverter) {
+	for _, objects := range [][]BeatObject{l.Waypoints, l.BasicEvents, l.ColorBoostEvents} {
+		for i, object := range objects {
+			objects[i].Beat = c.Beat(object.Beat)
+		}
+	}
+
+	boxData := map[int]*[]EventBoxDataV4{
+		lightColorEventBoxGroup:       &l.LightColorEventBoxes,
+		lightRotationEventBoxGroup:    &l.LightRotationEventBoxes,
+		lightTranslationEventBoxGroup: &l.LightTranslationEventBoxes,
+		fxEventBoxGroup:               &l.FXEventBoxes,
+	}
+	distributions := map[int]*sharedData{}
+	originalDistributions := map[int][]float64{}
+	for groupType, data := range boxData {
+		data := data
+		original := make([]float64, len(*data))
+		for i, box := range *data {
+			original[i] = box.BeatDistribution
+		}
+		originalDistributions[groupType] = original
+		distributions[groupType] = newSharedData(func(index int, distribution float64) {
+			(*data)[index].BeatDistribution = distribution
+		}, func(index int) int {
+			*data = append(*data, (*data)[index])
+			return len(*data) - 1
+		})
+	}
+
+	for i, group := range l.EventBoxGroups {
+		for j, box := range group.Boxes {
+			for k, event := range box.Events {
+				box.Events[k].Beat = c.Duration(group.Beat, event.Beat)
+			}
+			original := originalDistributions[group.Type]
+			if box.DataIndex >= 0 && box.DataIndex < len(original) {
+				distribution := c.Duration(group.Beat, original[box.DataIndex])
+				group.Boxes[j].DataIndex = distributions[group.Type].use(box.DataIndex, distribution)
+			}
+		}
+		l.EventBoxGroups[i].Beat = c.Beat(group.Beat)
+	}
+}
+
+// SetBPM does nothing; v4 lightshows have no BPM of their own.
+func (l *LightshowV4) SetBPM(bpm float64) {}
+
+// SetBeatsPerBar does nothing; v4 lightshows have no bar length.
+func (l *LightshowV4) SetBeatsPerBar(beats int) {}
+
+func (l *LightshowV4) TempoChanges() []tempoChange           { return nil }
+func (l *LightshowV4) SetTempoChanges(changes []tempoChange) {}
+
+func (l *LightshowV4) Counts() (notes, obstacles, events int) {
+	events = len(l.BasicEvents) + len(l.ColorBoostEvents)
+	for _, group := range l.EventBoxGroups {
+		for _, box := range group.Boxes {
+			events += len(box.Events)
+		}
+	}
+	return 0, 0, events
+}
+
+func (l *LightshowV4) Times() beatTimes {
+	var times beatTimes
+	times.Events = appendBeats(appendBeats(nil, l.BasicEvents), l.ColorBoostEvents)
+	for _, group := range l.EventBoxGroups {
+		for _, box := range group.Boxes {
+			for _, event := range box.Events {
+				times.Events = append(times.Events, group.Beat+event.Beat)
+			}
+		}
+	}
+	return times
+}
+
+// AudioDataV4 is the AudioData.dat file. Each bpmData region maps a range of
+// audio samples onto a range of beats, which is where the game actually gets
+// the song's tempo from in v4.
+type AudioDataV4 struct {
+	Version         string        `json:"version"`
+	SongSampleCount int           `json:"songSampleCount"`
+	SongFrequency   int           `json:"songFrequency"`
+	BPMData         []BPMRegionV4 `json:"bpmData"`
+
+	raw rawObject
+}
+
+type BPMRegionV4 struct {
+	StartIndex int     `json:"si"`
+	EndIndex   int     `json:"ei"`
+	StartBeat  float64 `json:"sb"`
+	EndBeat    float64 `json:"eb"`
+
+	raw rawObject
+}
+
+// TempoChanges turns each BPM region into a change marker at its start.
+func (a *AudioDataV4) TempoChanges() []tempoChange {
+	return a.tempoChangesAt(0)
+}
+
+// tempoChangesAt is TempoChanges, except that a region whose length is what
+// bpm gives, to the sample, is at exactly bpm. Sample counts are whole
+// numbers, so the BPM worked out from them is never quite the song's, even
+// in a region written at the song's BPM.
+func (a *AudioDataV4) tempoChangesAt(bpm float64) []tempoChange {
+	var changes []tempoChange
+	if a.SongFrequency <= 0 {
+		return nil
+	}
+	for _, region := range a.BPMData {
+		if region.EndIndex <= region.StartIndex {
+			continue
+		}
+		samples := float64(region.EndIndex - region.StartIndex)
+		change := tempoChange{Beat: region.StartBeat, BPM: (region.EndBeat - region.StartBeat) * 60 * float64(a.SongFrequency) / samples}
+		if bpm > 0 && math.Abs((region.EndBeat-region.StartBeat)*60/bpm*float64(a.SongFrequency)-samples) <= 1 {
+			change.BPM = bpm
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// Rescale converts the BPM regions for the output tempo. The sample ranges
+// stay where they are and their beats are converted. A file without regions
+// needs SetTempoMap instead.
+func (a *AudioDataV4) Rescale(c beatConverter) {
+	for i, region := range a.BPMData {
+		a.BPMData[i].StartBeat = c.Beat(region.StartBeat)
+		a.BPMData[i].EndBeat = c.Beat(region.EndBeat)
+	}
+}
+
+// SetTempoMap regenerates the BPM regions from scratch, with one region per
+// stretch of constant tempo in m.
+func (a *AudioDataV4) SetTempoMap(m tempoMap) {
+	if a.SongFrequency <= 0 {
+		return
+	}
+	frequency := float64(a.SongFrequency)
+	end := float64(a.SongSampleCount) / frequency
+	a.BPMData = nil
+	for i, segment := range m.segments {
+		start := math.Max(segment.seconds, 0)
+		stop := end
+		if i+1 < len(m.segments) {
+			stop = math.Min(m.segments[i+1].seconds, end)
+		}
+		if stop <= start {
+			continue
+		}
+		a.BPMData = append(a.BPMData, BPMRegionV4{
+			StartIndex: int(math.Round(start * frequency)),
+			EndIndex:   int(math.Round(stop * frequency)),
+			StartBeat:  m.Beat(start),
+			EndBeat:    m.Beat(stop),
+		})
+	}
+	a.raw.include("bpmData")
+}
+
+func (s *SongInfoV4) UnmarshalJSON(data []byte) error {
+	type songInfoV4 SongInfoV4
+	return unmarshalObject(data, (*songInfoV4)(s), &s.raw)
+}
+
+func (s SongInfoV4) MarshalJSON() ([]byte, error) {
+	type songInfoV4 SongInfoV4
+	return marshalObject(songInfoV4(s), s.raw)
+}
+
+func (a *AudioInfoV4) UnmarshalJSON(data []byte) error {
+	type audioInfoV4 AudioInfoV4
+	return unmarshalObject(data, (*audioInfoV4)(a), &a.raw)
+}
+
+func (a AudioInfoV4) MarshalJSON() ([]byte, error) {
+	type audioInfoV4 AudioInfoV4
+	return marshalObject(audioInfoV4(a), a.raw)
+}
+
+func (d *DifficultyBeatmapV4) UnmarshalJSON(data []byte) error {
+	type difficultyBeatmapV4 DifficultyBeatmapV4
+	return unmarshalObject(data, (*difficultyBeatmapV4)(d), &d.raw)
+}
+
+func (d DifficultyBeatmapV4) MarshalJSON() ([]byte, error) {
+	type difficultyBeatmapV4 DifficultyBeatmapV4
+	return marshalObject(difficultyBeatmapV4(d), d.raw)
+}
+
+func (b *BeatMapV4) UnmarshalJSON(data []byte) error {
+	type beatMapV4 BeatMapV4
+	return unmarshalObject(data, (*beatMapV4)(b), &b.raw)
+}
+
+func (b BeatMapV4) MarshalJSON() ([]byte, error) {
+	type beatMapV4 BeatMapV4
+	return marshalObject(beatMapV4(b), b.raw)
+}
+
+func (o *ObstacleV4) UnmarshalJSON(data []byte) error {
+	type obstacleV4 ObstacleV4
+	return unmarshalObject(data, (*obstacleV4)(o), &o.raw)
+}
+
+func (o ObstacleV4) MarshalJSON() ([]byte, error) {
+	type obstacleV4 ObstacleV4
+	return marshalObject(obstacleV4(o), o.raw)
+}
+
+func (o *ObstacleDataV4) UnmarshalJSON(data []byte) error {
+	type obstacleDataV4 ObstacleDataV4
+	return unmarshalObject(data, (*obstacleDataV4)(o), &o.raw)
+}
+
+func (o ObstacleDataV4) MarshalJSON() ([]byte, error) {
+	type obstacleDataV4 ObstacleDataV4
+	return marshalObject(obstacleDataV4(o), o.raw)
+}
+
+func (h *HeadTailV4) UnmarshalJSON(data []byte) error {
+	type headTailV4 HeadTailV4
+	return unmarshalObject(data, (*headTailV4)(h), &h.raw)
+}
+
+func (h HeadTailV4) MarshalJSON() ([]byte, error) {
+	type headTailV4 HeadTailV4
+	return marshalObject(headTailV4(h), h.raw)
+}
+
+func (l *LightshowV4) UnmarshalJSON(data []byte) error {
+	type lightshowV4 LightshowV4
+	return unmarshalObject(data, (*lightshowV4)(l), &l.raw)
+}
+
+func (l LightshowV4) MarshalJSON() ([]byte, error) {
+	type lightshowV4 LightshowV4
+	return marshalObject(lightshowV4(l), l.raw)
+}
+
+func (g *EventBoxGroupV4) UnmarshalJSON(data []byte) error {
+	type eventBoxGroupV4 EventBoxGroupV4
+	return unmarshalObject(data, (*eventBoxGroupV4)(g), &g.raw)
+}
+
+func (g EventBoxGroupV4) MarshalJSON() ([]byte, error) {
+	type eventBoxGroupV4 EventBoxGroupV4
+	return marshalObject(eventBoxGroupV4(g), g.raw)
+}
+
+func (b *EventBoxV4) UnmarshalJSON(data []byte) error {
+	type eventBoxV4 EventBoxV4
+	return unmarshalObject(data, (*eventBoxV4)(b), &b.raw)
+}
+
+func (b EventBoxV4) MarshalJSON() ([]byte, error) {
+	type eventBoxV4 EventBoxV4
+	return marshalObject(eventBoxV4(b), b.raw)
+}
+
+func (d *EventBoxDataV4) UnmarshalJSON(data []byte) error {
+	type eventBoxDataV4 EventBoxDataV4
+	return unmarshalObject(data, (*eventBoxDataV4)(d), &d.raw)
+}
+
+func (d EventBoxDataV4) MarshalJSON() ([]byte, error) {
+	type eventBoxDataV4 EventBoxDataV4
+	return marshalObject(eventBoxDataV4(d), d.raw)
+}
+
+func (a *AudioDataV4) UnmarshalJSON(data []byte) error {
+	type audioDataV4 AudioDataV4
+	return unmarshalObject(data, (*audioDataV4)(a), &a.raw)
+}
+
+func (a AudioDataV4) MarshalJSON() ([]byte, error) {
+	type audioDataV4 AudioDataV4
+	return marshalObject(audioDataV4(a), a.raw)
+}
+
+func (r *BPMRegionV4) UnmarshalJSON(data []byte) error {
+	type bpmRegionV4 BPMRegionV4
+	return unmarshalObject(data, (*bpmRegionV4)(r), &r.raw)
+}
+
+func (r BPMRegionV4) MarshalJSON() ([]byte, error) {
+	type bpmRegionV4 BPMRegionV4
+	return marshalObject(bpmRegionV4(r), r.raw)
+}
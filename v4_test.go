@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSong writes files into a new temporary song folder and returns it.
+func writeSong(t *testing.T, files map[string]string) string {
+	folder, err := ioutil.TempDir("", "bpm-saber-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(folder, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return folder
+}
+
+// v4Song is a v4 song at 174 BPM whose AudioData.dat region was written
+// for 174 BPM, rounded to whole samples as editors do.
+var v4Song = map[string]string{
+	"Info.dat": `{"version": "4.0.0", "song": {"title": "T"}, "audio": {"songFilename": "song.ogg", "audioDataFilename": "AudioData.dat", "bpm": 174},
+		"coverImageFilename": "cover.jpg", "difficultyBeatmaps": [
+		{"characteristic": "Standard", "difficulty": "Expert", "lightshowDataFilename": "Lightshow.dat", "beatmapDataFilename": "Expert.dat"}]}`,
+	"AudioData.dat": `{"version": "4.0.0", "songFrequency": 44100, "bpmData": [{"si": 0, "ei": 4562069, "sb": 0, "eb": 300}]}`,
+	"Expert.dat": `{"version": "4.0.0", "colorNotes": [{"b": 3, "i": 0}, {"b": 6, "i": 0}], "colorNotesData": [{"x": 1}],
+		"obstacles": [{"b": 12, "i": 0}], "obstaclesData": [{"d": 3}]}`,
+	"Lightshow.dat": `{"version": "4.0.0", "basicEvents": [{"b": 3, "i": 0}], "basicEventsData": [{"t": 1}]}`,
+	"song.ogg":      "",
+	"cover.jpg":     "",
+}
+
+// readBeats returns the "b" of every entry of the list key in a v4 file.
+func readBeats(t *testing.T, filePath, key string) []float64 {
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lists map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &lists); err != nil {
+		t.Fatal(err)
+	}
+	var entries []struct {
+		Beat float64 `json:"b"`
+	}
+	if err := json.Unmarshal(lists[key], &entries); err != nil {
+		t.Fatal(err)
+	}
+	var beats []float64
+	for _, entry := range entries {
+		beats = append(beats, entry.Beat)
+	}
+	return beats
+}
+
+func TestConvertV4ExactBeats(t *testing.T) {
+	defer useTestCache(t)()
+	input := writeSong(t, v4Song)
+	defer os.RemoveAll(input)
+	output, err := ioutil.TempDir("", "bpm-saber-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(output)
+
+	// ×3/4 leaves no rounding room: the trip through seconds at the BPM of
+	// the region's sample count would put beat 3 at 2.2500000000000004.
+	inputs, err := validateInputs(filepath.Join(input, "Info.dat"), output, "174", "130.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process(context.Background(), inputs, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		file, key string
+		want      []float64
+	}{
+		{"Expert.dat", "colorNotes", []float64{2.25, 4.5}},
+		{"Expert.dat", "obstacles", []float64{9}},
+		{"Lightshow.dat", "basicEvents", []float64{2.25}},
+	} {
+		got := readBeats(t, filepath.Join(output, test.file), test.key)
+		if len(got) != len(test.want) {
+			t.Errorf("%s %s: got %v, want %v", test.file, test.key, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s %s: got %v, want %v", test.file, test.key, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestBeatMapV4SharedObstacleData(t *testing.T) {
+	b := &BeatMapV4{
+		Obstacles:     []ObstacleV4{{Beat: 0, Index: 0}, {Beat: 4, Index: 0}, {Beat: 6, Index: 0}},
+		ObstaclesData: []ObstacleDataV4{{Duration: 2}},
+	}
+	// Beats 0 to 4 are played at twice the speed of beats 4 to 8, so the
+	// first obstacle's duration halves and the others' stays.
+	b.Rescale(newWarpConverter([]anchor{{4, 2}, {8, 6}}, 240))
+	if len(b.ObstaclesData) != 2 {
+		t.Fatalf("got %d obstacle data entries, want 2", len(b.ObstaclesData))
+	}
+	for i, want := range []struct {
+		beat     float64
+		index    int
+		duration float64
+	}{
+		{0, 0, 1},
+		{2, 1, 2},
+		{4, 1, 2},
+	} {
+		got := b.Obstacles[i]
+		if got.Beat != want.beat || got.Index != want.index || b.ObstaclesData[got.Index].Duration != want.duration {
+			t.Errorf("obstacle %d: beat %v, data %d of duration %v, want beat %v, data %d of duration %v",
+				i, got.Beat, got.Index, b.ObstaclesData[got.Index].Duration, want.beat, want.index, want.duration)
+		}
+	}
+}
+
+func TestLightshowV4SharedDistribution(t *testing.T) {
+	l := &LightshowV4{
+		EventBoxGroups: []EventBoxGroupV4{
+			{Type: lightColorEventBoxGroup, Beat: 0, Boxes: []EventBoxV4{{DataIndex: 0}}},
+			{Type: lightColorEventBoxGroup, Beat: 1, Boxes: []EventBoxV4{{DataIndex: 0}}},
+			{Type: lightColorEventBoxGroup, Beat: 4, Boxes: []EventBoxV4{{DataIndex: 0}}},
+			{Type: fxEventBoxGroup, Beat: 4, Boxes: []EventBoxV4{{DataIndex: 0}}},
+		},
+		LightColorEventBoxes: []EventBoxDataV4{{BeatDistribution: 2}},
+		FXEventBoxes:         []EventBoxDataV4{{BeatDistribution: 2}},
+	}
+	l.Rescale(newWarpConverter([]anchor{{4, 2}, {8, 6}}, 240))
+	// The groups at beats 0 and 1 agree on their distribution and keep
+	// sharing it. Each group type has its own data list to clone into.
+	if len(l.LightColorEventBoxes) != 2 || len(l.FXEventBoxes) != 1 {
+		t.Fatalf("got %d color and %d fx box data entries, want 2 and 1", len(l.LightColorEventBoxes), len(l.FXEventBoxes))
+	}
+	for i, want := range []struct {
+		index        int
+		distribution float64
+	}{
+		{0, 1},
+		{0, 1},
+		{1, 2},
+	} {
+		got := l.EventBoxGroups[i].Boxes[0].DataIndex
+		if got != want.index || l.LightColorEventBoxes[got].BeatDistribution != want.distribution {
+			t.Errorf("group %d: data %d of distribution %v, want data %d of distribution %v",
+				i, got, l.LightColorEventBoxes[got].BeatDistribution, want.index, want.distribution)
+		}
+	}
+	if got := l.FXEventBoxes[0].BeatDistribution; got != 2 {
+		t.Errorf("fx box distribution %v, want 2", got)
+	}
+}
+
+// sharedLightshowSong is v4Song with a second difficulty that shares the
+// lightshow.
+var sharedLightshowSong = map[string]string{
+	"Info.dat": `{"version": "4.0.0", "song": {"title": "T"}, "audio": {"songFilename": "song.ogg", "audioDataFilename": "AudioData.dat", "bpm": 174},
+		"coverImageFilename": "cover.jpg", "difficultyBeatmaps": [
+		{"characteristic": "Standard", "difficulty": "Expert", "lightshowDataFilename": "Lightshow.dat", "beatmapDataFilename": "Expert.dat"},
+		{"characteristic": "Standard", "difficulty": "Hard", "lightshowDataFilename": "Lightshow.dat", "beatmapDataFilename": "Hard.dat"}]}`,
+	"AudioData.dat": v4Song["AudioData.dat"],
+	"Expert.dat":    v4Song["Expert.dat"],
+	"Hard.dat":      v4Song["Expert.dat"],
+	"Lightshow.dat": v4Song["Lightshow.dat"],
+	"song.ogg":      "",
+	"cover.jpg":     "",
+}
+
+// convertExpertOnly converts the Expert difficulty of sharedLightshowSong
+// from 174 to 130.5 BPM, copying Hard, and returns the output folder.
+func convertExpertOnly(t *testing.T, fullSong bool) (string, *conversionReport) {
+	input := writeSong(t, sharedLightshowSong)
+	defer os.RemoveAll(input)
+	output, err := ioutil.TempDir("", "bpm-saber-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs, err := validateInputs(filepath.Join(input, "Info.dat"), output, "174", "130.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs.Difficulties = []string{"Standard/Expert"}
+	inputs.CopyUnselected = true
+	inputs.FullSong = fullSong
+	report, err := process(context.Background(), inputs, nil)
+	if err != nil {
+		os.RemoveAll(output)
+		t.Fatal(err)
+	}
+	return output, report
+}
+
+func TestCopyUnselectedClonesSharedLightshow(t *testing.T) {
+	defer useTestCache(t)()
+	output, _ := convertExpertOnly(t, true)
+	defer os.RemoveAll(output)
+
+	if got := readBeats(t, filepath.Join(output, "Lightshow.dat"), "basicEvents"); len(got) != 1 || got[0] != 2.25 {
+		t.Errorf("Lightshow.dat basicEvents: got %v, want [2.25]", got)
+	}
+	if got := readBeats(t, filepath.Join(output, "Lightshow.unconverted.dat"), "basicEvents"); len(got) != 1 || got[0] != 3 {
+		t.Errorf("Lightshow.unconverted.dat basicEvents: got %v, want [3]", got)
+	}
+	if got := readBeats(t, filepath.Join(output, "Hard.dat"), "colorNotes"); len(got) != 2 || got[0] != 3 {
+		t.Errorf("Hard.dat colorNotes: got %v, want [3 6]", got)
+	}
+	songInfo, err := loadSongInfo(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lightshows := map[string]string{}
+	for _, d := range songInfo.Difficulties() {
+		lightshows[d.Name] = d.LightshowPath
+	}
+	if lightshows["Expert"] != "Lightshow.dat" || lightshows["Hard"] != "Lightshow.unconverted.dat" {
+		t.Errorf("got lightshows %v, want Expert on Lightshow.dat and Hard on Lightshow.unconverted.dat", lightshows)
+	}
+}
+
+func TestCopyUnselectedReportsSharedLightshow(t *testing.T) {
+	defer useTestCache(t)()
+	// Without the song info there is nowhere to point Hard at a copy.
+	output, report := convertExpertOnly(t, false)
+	defer os.RemoveAll(output)
+
+	if _, err := os.Lstat(filepath.Join(output, "Lightshow.unconverted.dat")); !os.IsNotExist(err) {
+		t.Errorf("Lightshow.unconverted.dat was written: %v", err)
+	}
+	for _, result := range report.Difficulties {
+		if result.Difficulty != "Standard/Hard" {
+			continue
+		}
+		for _, warning := range result.Warnings {
+			if warning == "shares Lightshow.dat with a converted difficulty, so it was converted too" {
+				return
+			}
+		}
+		t.Fatalf("Hard's warnings %q don't mention the shared lightshow", result.Warnings)
+	}
+	t.Fatal("Hard is missing from the report")
+}
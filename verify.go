@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// verifyTolerance is how far, in seconds, an object may drift from its
+// moment in the song before a conversion is considered broken. It allows
+// for float rounding and nothing else.
+const verifyTolerance = 0.001
+
+// maxReportedDrifts limits how many objects a verification failure lists.
+const maxReportedDrifts = 5
+
+// objectDrift is an object whose time in seconds changed in a conversion.
+type objectDrift struct {
+	kind   string
+	before float64
+	after  float64
+}
+
+func (d objectDrift) seconds() float64 { return d.after - d.before }
+
+func (d objectDrift) String() string {
+	return fmt.Sprintf("%s at %.3fs is now at %.3fs (%+.1fms)", d.kind, d.before, d.after, d.seconds()*1000)
+}
+
+// verifyFile checks that every object of a converted file still falls on
+// the moment of the song it did before, with before and input describing the
+// file as it was read and after and output the file as it was written.
+// Objects may drift by up to tolerance seconds. It returns the largest drift
+// in seconds.
+func verifyFile(relativePath string, before beatTimes, input tempoMap, after beatTimes, output tempoMap, tolerance float64) (float64, error) {
+	var drifts []objectDrift
+	for _, objects := range []struct {
+		kind          string
+		before, after []float64
+	}{
+		{"note", before.Notes, after.Notes},
+		{"obstacle", before.Obstacles, after.Obstacles},
+		{"event", before.Events, after.Events},
+	} {
+		if len(objects.before) != len(objects.after) {
+			return 0, fmt.Errorf("verifying '%s': %d %ss were read but %d were written", relativePath, len(objects.before), objects.kind, len(objects.after))
+		}
+		for i := range objects.before {
+			drifts = append(drifts, objectDrift{
+				kind:   objects.kind,
+				before: input.Seconds(objects.before[i]),
+				after:  output.Seconds(objects.after[i]),
+			})
+		}
+	}
+	sort.SliceStable(drifts, func(i, j int) bool { return math.Abs(drifts[i].seconds()) > math.Abs(drifts[j].seconds()) })
+	if len(drifts) == 0 {
+		return 0, nil
+	}
+
+	worst := math.Abs(drifts[0].seconds())
+	if worst <= tolerance {
+		return worst, nil
+	}
+	drifted := 0
+	for _, d := range drifts {
+		if math.Abs(d.seconds()) > tolerance {
+			drifted++
+		}
+	}
+	if len(drifts) > maxReportedDrifts {
+		drifts = drifts[:maxReportedDrifts]
+	}
+	var offenders []string
+	for _, d := range drifts {
+		if math.Abs(d.seconds()) > tolerance {
+			offenders = append(offenders, d.String())
+		}
+	}
+	return worst, fmt.Errorf("verifying '%s': %d objects drifted more than %.3gms from their place in the song, worst: %s", relativePath, drifted, tolerance*1000, strings.Join(offenders, "; "))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestVerifyFileExact(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after beatTimes
+		input, output tempoMap
+	}{
+		{
+			"tempo change",
+			beatTimes{Notes: []float64{0, 4, 10}, Obstacles: []float64{8}, Events: []float64{12}},
+			beatTimes{Notes: []float64{0, 6, 15}, Obstacles: []float64{12}, Events: []float64{18}},
+			newTempoMap(120, []tempoChange{{Beat: 8, BPM: 60}}, 0),
+			newTempoMap(180, []tempoChange{{Beat: 12, BPM: 90}}, 0),
+		},
+		{
+			// A baked offset delays the objects instead of the whole map.
+			"baked offset",
+			beatTimes{Notes: []float64{0, 4}},
+			beatTimes{Notes: []float64{0.5, 4.5}},
+			newTempoMap(120, nil, 250),
+			newTempoMap(120, nil, 0),
+		},
+		{"empty", beatTimes{}, beatTimes{}, newTempoMap(120, nil, 0), newTempoMap(90, nil, 0)},
+	}
+	for _, test := range tests {
+		drift, err := verifyFile("Expert.dat", test.before, test.input, test.after, test.output, verifyTolerance)
+		if err != nil || drift > 1e-9 {
+			t.Errorf("%s: got drift %v, %v, want none", test.name, drift, err)
+		}
+	}
+}
+
+func TestVerifyFileDrift(t *testing.T) {
+	input := newTempoMap(120, nil, 0)
+	before := beatTimes{Notes: []float64{0, 4}, Obstacles: []float64{8}}
+
+	// Half a millisecond is within verifyTolerance and is reported as the
+	// largest drift.
+	drift, err := verifyFile("Expert.dat", before, input, beatTimes{Notes: []float64{0, 4.001}, Obstacles: []float64{8}}, input, verifyTolerance)
+	if err != nil || math.Abs(drift-0.0005) > 1e-9 {
+		t.Errorf("drift within tolerance: got %v, %v, want 0.0005", drift, err)
+	}
+
+	// Five milliseconds is not, unless the tolerance allows for it, as it
+	// does for snapping.
+	after := beatTimes{Notes: []float64{0, 4}, Obstacles: []float64{8.01}}
+	drift, err = verifyFile("Expert.dat", before, input, after, input, verifyTolerance)
+	if err == nil {
+		t.Fatal("a 5ms drift passed verification")
+	}
+	if math.Abs(drift-0.005) > 1e-9 {
+		t.Errorf("got drift %v, want 0.005", drift)
+	}
+	want := "verifying 'Expert.dat': 1 objects drifted more than 1ms from their place in the song, worst: obstacle at 4.000s is now at 4.005s (+5.0ms)"
+	if err.Error() != want {
+		t.Errorf("got error '%s', want '%s'", err, want)
+	}
+	if _, err := verifyFile("Expert.dat", before, input, after, input, verifyTolerance+0.01); err != nil {
+		t.Errorf("a 5ms drift failed with a 11ms tolerance: %s", err)
+	}
+}
+
+func TestVerifyFileLimitsReport(t *testing.T) {
+	input := newTempoMap(60, nil, 0)
+	var before, after beatTimes
+	for i := 0; i < maxReportedDrifts+3; i++ {
+		before.Events = append(before.Events, float64(i))
+		after.Events = append(after.Events, float64(i)+0.1)
+	}
+	_, err := verifyFile("Lightshow.dat", before, input, after, input, verifyTolerance)
+	if err == nil {
+		t.Fatal("drifted events passed verification")
+	}
+	drifted := fmt.Sprintf("%d objects drifted", len(before.Events))
+	if !strings.Contains(err.Error(), drifted) || strings.Count(err.Error(), "event at") != maxReportedDrifts {
+		t.Errorf("got error '%s', want %s with %d listed", err, drifted, maxReportedDrifts)
+	}
+}
+
+func TestVerifyFileCountMismatch(t *testing.T) {
+	input := newTempoMap(120, nil, 0)
+	_, err := verifyFile("Expert.dat", beatTimes{Notes: []float64{0, 4}}, input, beatTimes{Notes: []float64{0}}, input, verifyTolerance)
+	if want := "verifying 'Expert.dat': 2 notes were read but 1 were written"; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want '%s'", err, want)
+	}
+}
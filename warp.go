@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// anchor pins a beat in the input beatmap (as placed in the editor) to the
+// beat at the output BPM where it really falls in the song. A list of
+// anchors describes a time warp for songs that drift, such as live
+// recordings, which no single BPM ratio can fix.
+type anchor struct {
+	EditorBeat float64
+	RealBeat   float64
+}
+
+func (a anchor) String() string {
+	return floatToString(a.EditorBeat) + "=" + floatToString(a.RealBeat)
+}
+
+func parseAnchor(text string) (anchor, error) {
+	parts := strings.Split(text, "=")
+	if len(parts) != 2 {
+		return anchor{}, fmt.Errorf("anchor '%s': must look like EDITOR_BEAT=REAL_BEAT", text)
+	}
+	editorBeat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return anchor{}, fmt.Errorf("anchor '%s': %s", text, err)
+	}
+	realBeat, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return anchor{}, fmt.Errorf("anchor '%s': %s", text, err)
+	}
+	return anchor{EditorBeat: editorBeat, RealBeat: realBeat}, nil
+}
+
+// parseAnchors parses a comma separated list of anchors, as typed into the
+// GUI.
+func parseAnchors(text string) ([]anchor, error) {
+	var anchors []anchor
+	for _, field := range strings.Split(text, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		a, err := parseAnchor(field)
+		if err != nil {
+			return nil, err
+		}
+		anchors = append(anchors, a)
+	}
+	return anchors, checkAnchors(anchors)
+}
+
+func formatAnchors(anchors []anchor) string {
+	var fields []string
+	for _, a := range anchors {
+		fields = append(fields, a.String())
+	}
+	return strings.Join(fields, ", ")
+}
+
+// checkAnchors sorts anchors by editor beat and makes sure that time never
+// runs backwards or stands still between them, counting from the start of
+// the song that warpPoints pins in place. No anchors at all is no warp.
+func checkAnchors(anchors []anchor) error {
+	if len(anchors) == 0 {
+		return nil
+	}
+	sort.Slice(anchors, func(i, j int) bool { return anchors[i].EditorBeat < anchors[j].EditorBeat })
+	for _, a := range anchors {
+		if a.EditorBeat < 0 || a.RealBeat < 0 {
+			return fmt.Errorf("anchor '%s': beats must not be negative", a)
+		}
+	}
+	points := warpPoints(anchors)
+	if len(points) < 2 {
+		return fmt.Errorf("anchor '%s': a warp needs an anchor after editor beat 0", points[0])
+	}
+	for i := 1; i < len(points); i++ {
+		if points[i].EditorBeat == points[i-1].EditorBeat || points[i].RealBeat <= points[i-1].RealBeat {
+			return fmt.Errorf("anchors '%s' and '%s': later editor beats must map to later real beats", points[i-1], points[i])
+		}
+	}
+	return nil
+}
+
+// anchorList is a repeatable -anchor flag. The anchors can only be checked
+// together, with checkAnchors, once every flag is parsed.
+type anchorList []anchor
+
+func (l *anchorList) String() string {
+	if l == nil {
+		return ""
+	}
+	return formatAnchors(*l)
+}
+
+func (l *anchorList) Set(value string) error {
+	a, err := parseAnchor(value)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, a)
+	return nil
+}
+
+// warpPoints returns the anchors with the start of the song pinned in
+// place, which is where every warp begins.
+func warpPoints(anchors []anchor) []anchor {
+	if len(anchors) > 0 && anchors[0].EditorBeat == 0 {
+		return anchors
+	}
+	return append([]anchor{{}}, anchors...)
+}
+
+// warpConverter applies the piecewise linear warp described by the anchors.
+// Past the last anchor the last stretch's tempo carries on. The output runs
+// at a constant tempo, so any BPM change markers in the input are set to
+// the output BPM.
+type warpConverter struct {
+	points    []anchor
+	outputBPM float64
+}
+
+func newWarpConverter(anchors []anchor, outputBPM float64) warpConverter {
+	return warpConverter{points: warpPoints(anchors), outputBPM: outputBPM}
+}
+
+// Beat needs at least two points, which checkAnchors makes sure of.
+func (c warpConverter) Beat(beat float64) float64 {
+	i := 0
+	for i+2 < len(c.points) && c.points[i+1].EditorBeat <= beat {
+		i++
+	}
+	from, to := c.points[i], c.points[i+1]
+	return from.RealBeat + (beat-from.EditorBeat)*(to.RealBeat-from.RealBeat)/(to.EditorBeat-from.EditorBeat)
+}
+
+func (c warpConverter) Duration(beat, duration float64) float64 {
+	return c.Beat(beat+duration) - c.Beat(beat)
+}
+
+func (c warpConverter) Tempo(beat, bpm float64) float64 {
+	return c.outputBPM
+}
+
+// warpMarkers is the alternative to warping every object: the objects only
+// get the plain BPM ratio, which keeps them on the editor's grid, and BPM
+// change markers at each anchor make the grid itself follow the song.
+func warpMarkers(anchors []anchor, inputBPM, outputBPM float64) []tempoChange {
+	points := warpPoints(anchors)
+	ratio := outputBPM / inputBPM
+	var changes []tempoChange
+	for i := 0; i+1 < len(points); i++ {
+		from, to := points[i], points[i+1]
+		gridBeats := (to.EditorBeat - from.EditorBeat) * ratio
+		changes = append(changes, tempoChange{
+			Beat: from.EditorBeat * ratio,
+			BPM:  outputBPM * gridBeats / (to.RealBeat - from.RealBeat),
+		})
+	}
+	return changes
+}
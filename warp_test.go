@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestCheckAnchors(t *testing.T) {
+	tests := []struct {
+		anchors []anchor
+		ok      bool
+	}{
+		{nil, true},
+		{[]anchor{{4, 2}}, true},
+		{[]anchor{{8, 6}, {4, 2}}, true},
+		{[]anchor{{0, 1}, {4, 3}}, true},
+		// Only the start of the song is pinned, which is no warp at all.
+		{[]anchor{{0, 5}}, false},
+		// Time stands still from the start of the song.
+		{[]anchor{{4, 0}}, false},
+		{[]anchor{{4, 2}, {8, 2}}, false},
+		{[]anchor{{4, 2}, {4, 3}}, false},
+		{[]anchor{{4, 3}, {8, 2}}, false},
+		{[]anchor{{-1, 2}}, false},
+	}
+	for _, test := range tests {
+		err := checkAnchors(test.anchors)
+		if (err == nil) != test.ok {
+			t.Errorf("checkAnchors(%v) = %v, want ok %v", test.anchors, err, test.ok)
+		}
+	}
+}
+
+func TestWarpConverter(t *testing.T) {
+	c := newWarpConverter([]anchor{{4, 2}, {8, 6}}, 240)
+	tests := []struct {
+		beat, want float64
+	}{
+		{0, 0},
+		{2, 1},
+		{4, 2},
+		{6, 4},
+		{8, 6},
+		// Past the last anchor the last stretch's tempo carries on.
+		{10, 8},
+	}
+	for _, test := range tests {
+		if got := c.Beat(test.beat); got != test.want {
+			t.Errorf("Beat(%v) = %v, want %v", test.beat, got, test.want)
+		}
+	}
+	if got := c.Duration(2, 4); got != 3 {
+		t.Errorf("Duration(2, 4) = %v, want 3", got)
+	}
+	if got := c.Tempo(0, 120); got != 240 {
+		t.Errorf("Tempo(0, 120) = %v, want 240", got)
+	}
+
+	// An anchor at editor beat 0 takes the place of the start of the song.
+	c = newWarpConverter([]anchor{{0, 1}, {4, 3}}, 240)
+	if got := c.Beat(2); got != 2 {
+		t.Errorf("Beat(2) with an anchor at 0 = %v, want 2", got)
+	}
+}